@@ -0,0 +1,142 @@
+package tagpipe
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Cache holds parsed files by the MD5 sum of their contents, to avoid parsing the
+// same file again. It's safe for concurrent use by digesters.
+type Cache struct {
+	mu sync.RWMutex
+	m  map[string]Result
+}
+
+// DefaultCache is the cache used by DigestAllFiles
+var DefaultCache = &Cache{}
+
+// Snapshot returns a deep copy of the cached results, keyed by MD5 sum. It can be
+// iterated and modified freely without affecting the cache.
+func (c *Cache) Snapshot() map[string]Result {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	m := make(map[string]Result, len(c.m))
+	for sum, r := range c.m {
+		t := make(map[string]int, len(r.T))
+		for tag, n := range r.T {
+			t[tag] = n
+		}
+		r.T = t
+		m[sum] = r
+	}
+	return m
+}
+
+func (c *Cache) get(sum string) (Result, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	r, ok := c.m[sum]
+	return r, ok
+}
+
+func (c *Cache) put(sum string, r Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]Result)
+	}
+	c.m[sum] = r
+}
+
+// reset replaces the contents of the cache with m
+func (c *Cache) reset(m map[string]Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = m
+}
+
+// cacheVersion is the version of the format of the cache file, to be bumped
+// whenever the format changes
+const cacheVersion = 1
+
+// ErrCacheVersionMismatch is returned by LoadCache for a cache file saved in an
+// older or newer format, which callers would usually ignore and rebuild
+var ErrCacheVersionMismatch = errors.New("cache file version mismatch")
+
+// cacheFile is the format of the cache file
+type cacheFile struct {
+	Version int
+	Results map[string]Result
+}
+
+// LoadCache tries to parse a previously saved cache file. A file saved in another
+// format fails with ErrCacheVersionMismatch, including ones from before the
+// format was versioned.
+func LoadCache() (map[string]Result, error) {
+	defer TimeTrack(time.Now(), "LoadCache")
+
+	dat, e1 := os.ReadFile("cache")
+	if e1 != nil {
+		return nil, e1
+	}
+
+	var c cacheFile
+	if e2 := json.Unmarshal(dat, &c); e2 != nil {
+		return nil, e2
+	}
+	// unversioned files, maps of results by sum, leave Version 0
+	if c.Version != cacheVersion {
+		return nil, fmt.Errorf("%w: version %d, want %d", ErrCacheVersionMismatch, c.Version, cacheVersion)
+	}
+
+	return c.Results, nil
+}
+
+// SaveCache will save parsing results of all files in a file named "cache"
+func SaveCache(cache map[string]Result) bool {
+	defer TimeTrack(time.Now(), "SaveCache")
+
+	// marshall cache into JSON array
+	cacheJSON, errj := json.Marshal(cacheFile{Version: cacheVersion, Results: cache})
+	if errj != nil {
+		log.Println(errj)
+		return false
+	}
+
+	err := os.WriteFile("cache", cacheJSON, 0644)
+	if err != nil {
+		return false
+	}
+	return true
+}
+
+// SaveCacheGob writes the results in DefaultCache to w with encoding/gob, which
+// is faster to load than the JSON of SaveCache and more compact, but isn't
+// human-readable and can only be read back by Go
+func SaveCacheGob(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(cacheFile{Version: cacheVersion, Results: DefaultCache.Snapshot()})
+}
+
+// LoadCacheGob replaces the results in DefaultCache with those read from r, as
+// written by SaveCacheGob. A cache saved in another format fails with
+// ErrCacheVersionMismatch, leaving DefaultCache as it was.
+func LoadCacheGob(r io.Reader) error {
+	var c cacheFile
+	if err := gob.NewDecoder(r).Decode(&c); err != nil {
+		return err
+	}
+	if c.Version != cacheVersion {
+		return fmt.Errorf("%w: version %d, want %d", ErrCacheVersionMismatch, c.Version, cacheVersion)
+	}
+
+	DefaultCache.reset(c.Results)
+	return nil
+}
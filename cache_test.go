@@ -0,0 +1,124 @@
+package tagpipe
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCacheSnapshotIsACopy(t *testing.T) {
+	var c Cache
+	c.put("sum", Result{Path: "a.json", Sum: "sum", T: map[string]int{"go": 1}})
+
+	snap := c.Snapshot()
+	snap["sum"].T["go"] = 100
+	snap["sum"].T["rust"] = 1
+	delete(snap, "sum")
+	snap["other"] = Result{}
+
+	r, ok := c.get("sum")
+	if !ok {
+		t.Fatal("result removed from the cache")
+	}
+	if want := map[string]int{"go": 1}; !reflect.DeepEqual(r.T, want) {
+		t.Errorf("cached counts = %v, want %v", r.T, want)
+	}
+	if _, ok := c.get("other"); ok {
+		t.Error("result added to the cache")
+	}
+}
+
+// inTempDir runs the rest of the test in a new temporary directory, as the cache
+// file is saved to and loaded from the working directory
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestLoadCacheVersion(t *testing.T) {
+	inTempDir(t)
+
+	results := map[string]Result{"sum": {Path: "a.json", Sum: "sum", Size: 6, T: map[string]int{"go": 1}}}
+	if !SaveCache(results) {
+		t.Fatal("SaveCache failed")
+	}
+	got, err := LoadCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, results) {
+		t.Errorf("loaded %v, want %v", got, results)
+	}
+
+	for name, content := range map[string]string{
+		"newer":       `{"Version": 2, "Results": {}}`,
+		"unversioned": `{"sum": {"Path": "a.json", "Sum": "sum"}}`,
+	} {
+		if err := os.WriteFile("cache", []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadCache(); !errors.Is(err, ErrCacheVersionMismatch) {
+			t.Errorf("%s cache: err = %v, want ErrCacheVersionMismatch", name, err)
+		}
+	}
+
+	if err := os.WriteFile("cache", []byte(`{"Version": `), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCache(); err == nil || errors.Is(err, ErrCacheVersionMismatch) {
+		t.Errorf("corrupt cache: err = %v, want a parse error", err)
+	}
+}
+
+func TestCacheGobRoundTrip(t *testing.T) {
+	saved := DefaultCache.Snapshot()
+	defer DefaultCache.reset(saved)
+
+	want := map[string]Result{
+		"sum1": {Path: "a.json", Sum: "sum1", Size: 12, T: map[string]int{"go": 2, "rust": 1}},
+		"sum2": {Path: "sub/b.json", Sum: "sum2", Size: 2, T: map[string]int{}},
+	}
+	DefaultCache.reset(want)
+
+	var buf bytes.Buffer
+	if err := SaveCacheGob(&buf); err != nil {
+		t.Fatal(err)
+	}
+	DefaultCache.reset(nil)
+	if err := LoadCacheGob(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got := DefaultCache.Snapshot()
+	// gob decodes empty maps as nil
+	for sum, r := range got {
+		if r.T == nil {
+			r.T = map[string]int{}
+			got[sum] = r
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %v, want %v", got, want)
+	}
+
+	buf.Reset()
+	if err := gob.NewEncoder(&buf).Encode(cacheFile{Version: cacheVersion + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadCacheGob(&buf); !errors.Is(err, ErrCacheVersionMismatch) {
+		t.Errorf("newer cache: err = %v, want ErrCacheVersionMismatch", err)
+	}
+	if n := len(DefaultCache.Snapshot()); n != len(want) {
+		t.Errorf("cache holds %d results after a failed load, want %d", n, len(want))
+	}
+}
@@ -0,0 +1,228 @@
+package tagpipe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// checkpointEvery is the number of files ScanTreeResumable processes between
+// flushing their records to the checkpoint
+const checkpointEvery = 100
+
+// checkpointRecord is a line of a checkpoint: the tag counts of a file
+type checkpointRecord struct {
+	Path string         `json:"path"`
+	Tags map[string]int `json:"tags"`
+}
+
+// ScanTreeResumable scans the file tree rooted at root like ScanTree, recording
+// the tag counts of each file processed in the file named checkpoint. The
+// checkpoint is a JSON Lines log a record is appended to for each file,
+// flushed every so often and when the scan ends, whether it completed, failed
+// or ran out of Timeout, so running it again over the same tree carries on
+// where it stopped, skipping the files already recorded. Only files being read
+// when it stopped are read again. When the scan ends the log is compacted to
+// one record per file. The results are read from the checkpoint with
+// LoadCheckpoint.
+func ScanTreeResumable(root, checkpoint string, tags []string, opts ...Option) (err error) {
+	o := newOptions(opts)
+	ctx := context.Background()
+	var cancel context.CancelFunc
+	if o.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	tags, err = normalizeTags(tags, o)
+	if err != nil {
+		return err
+	}
+	state, torn, err := loadCheckpoint(checkpoint)
+	if errors.Is(err, fs.ErrNotExist) {
+		state = make(map[string]map[string]int)
+	} else if err != nil {
+		return err
+	}
+	// appending after a record cut short would run the two together
+	if torn {
+		if err := saveCheckpoint(checkpoint, state); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(checkpoint, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o666)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	defer func() {
+		ferr := w.Flush()
+		if cerr := f.Close(); ferr == nil {
+			ferr = cerr
+		}
+		if ferr == nil {
+			ferr = saveCheckpoint(checkpoint, state)
+		}
+		if err == nil {
+			err = ferr
+		}
+	}()
+
+	// the set of paths to skip, read by the walk while state is added to
+	processed := make(map[string]bool, len(state))
+	for path := range state {
+		processed[path] = true
+	}
+
+	paths, errc, fc := walkFiles(ctx.Done(), root, o)
+	todo := make(chan string)
+	go func() {
+		defer close(todo)
+		for path := range paths {
+			if processed[o.key(root, path)] {
+				continue
+			}
+			select {
+			case todo <- path:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	c := processFiles(ctx.Done(), todo, digesterCount(fc), root, o, func(path string) Result {
+		return parsePath(path, tags, o)
+	})
+
+	n := 0
+collect:
+	for {
+		select {
+		case r, ok := <-c:
+			if !ok {
+				break collect
+			}
+			if r.E != nil {
+				if skipped(r) {
+					continue
+				}
+				return r.E
+			}
+
+			if r.T == nil {
+				r.T = make(map[string]int)
+			}
+			state[r.Path] = r.T
+			if err := enc.Encode(checkpointRecord{Path: r.Path, Tags: r.T}); err != nil {
+				return err
+			}
+			if n++; n%checkpointEvery == 0 {
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+		case <-ctx.Done():
+			// don't wait for reads in flight, which may never end
+			break collect
+		}
+	}
+
+	// out of time, the checkpoint has what we have
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Check whether the Walk failed.
+	return <-errc
+}
+
+// LoadCheckpoint reads the checkpoint file written by ScanTreeResumable, returning
+// the counts of tags found in each file processed so far
+func LoadCheckpoint(checkpoint string) (map[string]map[string]int, error) {
+	state, _, err := loadCheckpoint(checkpoint)
+	return state, err
+}
+
+// loadCheckpoint reads the records of the checkpoint file, later ones taking
+// precedence, and reports whether the last of them was cut short, as by a crash
+// while it was written, in which case it is left out
+func loadCheckpoint(checkpoint string) (state map[string]map[string]int, torn bool, err error) {
+	f, err := os.Open(checkpoint)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	state = make(map[string]map[string]int)
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				return state, true, nil
+			}
+			return state, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var rec checkpointRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, false, fmt.Errorf("checkpoint %s: %w", checkpoint, err)
+		}
+		if rec.Tags == nil {
+			rec.Tags = make(map[string]int)
+		}
+		state[rec.Path] = rec.Tags
+	}
+}
+
+// saveCheckpoint writes state to the file named checkpoint, a record per file,
+// through a temporary file renamed over it, so an interrupted write never
+// leaves it truncated
+func saveCheckpoint(checkpoint string, state map[string]map[string]int) error {
+	f, err := os.CreateTemp(filepath.Dir(checkpoint), filepath.Base(checkpoint)+".*")
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(state))
+	for path := range state {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, path := range paths {
+		if err = enc.Encode(checkpointRecord{Path: path, Tags: state[path]}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), checkpoint)
+}
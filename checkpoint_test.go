@@ -0,0 +1,119 @@
+package tagpipe
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// openLogFS records the names of the files opened in it
+type openLogFS struct {
+	fs.FS
+	mu     sync.Mutex
+	opened map[string]int
+}
+
+func (l *openLogFS) Open(name string) (fs.File, error) {
+	f, err := l.FS.Open(name)
+	if err == nil {
+		if info, serr := f.Stat(); serr == nil && !info.IsDir() {
+			l.mu.Lock()
+			l.opened[name]++
+			l.mu.Unlock()
+		}
+	}
+	return f, err
+}
+
+func TestScanTreeResumable(t *testing.T) {
+	files := fstest.MapFS{}
+	want := make(map[string]map[string]int)
+	for i := 0; i < 250; i++ {
+		name := fmt.Sprintf("d%d/f%03d.json", i%5, i)
+		files[name] = &fstest.MapFile{Data: []byte(`["go", "go"]`)}
+		want[name] = map[string]int{"go": 2}
+	}
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	// interrupted by the timeout while a file is stuck
+	first := &openLogFS{FS: newStuckFS(t, files, "d2/f127.json"), opened: make(map[string]int)}
+	err := ScanTreeResumable(".", checkpoint, []string{"go"}, WithFS(first), WithTimeout(300*time.Millisecond))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	done, err := LoadCheckpoint(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := done["d2/f127.json"]; ok || len(done) == 0 {
+		t.Fatalf("checkpoint of %d files, want some but not the stuck one", len(done))
+	}
+
+	second := &openLogFS{FS: files, opened: make(map[string]int)}
+	if err := ScanTreeResumable(".", checkpoint, []string{"go"}, WithFS(second)); err != nil {
+		t.Fatal(err)
+	}
+	for name := range second.opened {
+		if _, ok := done[name]; ok {
+			t.Errorf("%s processed again after resuming", name)
+		}
+	}
+	for name, n := range second.opened {
+		if n > 1 {
+			t.Errorf("%s opened %d times resuming", name, n)
+		}
+	}
+
+	got, err := LoadCheckpoint(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("checkpoint of %d files after resuming, want all %d counted", len(got), len(want))
+	}
+}
+
+func TestCheckpointLog(t *testing.T) {
+	files := fstest.MapFS{
+		"a.json": {Data: []byte(`["go"]`)},
+		"b.json": {Data: []byte(`["go", "go"]`)},
+		"c.json": {Data: []byte(`["go", "go", "go"]`)},
+	}
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	// a record for a, replaced by a later one, then one for b cut short
+	log := `{"path":"a.json","tags":{"go":5}}` + "\n" +
+		`{"path":"a.json","tags":{"go":1}}` + "\n" +
+		`{"path":"b.json","tags":{"g`
+	if err := os.WriteFile(checkpoint, []byte(log), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := LoadCheckpoint(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]map[string]int{"a.json": {"go": 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %v, want %v", got, want)
+	}
+
+	if err := ScanTreeResumable(".", checkpoint, []string{"go"}, WithFS(files)); err != nil {
+		t.Fatal(err)
+	}
+	dat, err := os.ReadFile(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"path":"a.json","tags":{"go":1}}` + "\n" +
+		`{"path":"b.json","tags":{"go":2}}` + "\n" +
+		`{"path":"c.json","tags":{"go":3}}` + "\n"
+	if string(dat) != want {
+		t.Errorf("compacted checkpoint:\n%s\nwant:\n%s", dat, want)
+	}
+}
@@ -0,0 +1,75 @@
+package tagpipe
+
+import "bytes"
+
+// goComments extracts the text of comments from Go source fed to it line by line,
+// leaving out code, string and rune literals. It carries block comments and raw
+// strings over from one line to the next, so a new one is needed per input.
+type goComments struct {
+	inBlock bool // inside /* */
+	inRaw   bool // inside a raw `string`
+}
+
+// line returns the comment text of line, comments on the same line separated by
+// a space so their words don't run together
+func (g *goComments) line(line []byte) []byte {
+	var out []byte
+	for i := 0; i < len(line); {
+		switch {
+		case g.inBlock:
+			j := bytes.Index(line[i:], []byte("*/"))
+			if j < 0 {
+				return append(out, line[i:]...)
+			}
+			out = append(append(out, line[i:i+j]...), ' ')
+			i += j + 2
+			g.inBlock = false
+		case g.inRaw:
+			j := bytes.IndexByte(line[i:], '`')
+			if j < 0 {
+				return out
+			}
+			i += j + 1
+			g.inRaw = false
+		case bytes.HasPrefix(line[i:], []byte("//")):
+			return append(out, line[i+2:]...)
+		case bytes.HasPrefix(line[i:], []byte("/*")):
+			g.inBlock = true
+			i += 2
+		case line[i] == '`':
+			g.inRaw = true
+			i++
+		case line[i] == '"' || line[i] == '\'':
+			i = skipQuoted(line, i)
+		default:
+			i++
+		}
+	}
+	return out
+}
+
+// skipQuoted returns the index just past the interpreted string or rune literal
+// starting at line[i], or the end of line if it's not terminated
+func skipQuoted(line []byte, i int) int {
+	quote := line[i]
+	for i++; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case quote:
+			return i + 1
+		}
+	}
+	return len(line)
+}
+
+// newLineFilter returns the func lines go through before tags are matched in them,
+// which keeps only comments when o.CommentsOnly is set. It's stateful, so each
+// input needs its own.
+func newLineFilter(o *Options) func(line []byte) []byte {
+	if !o.CommentsOnly {
+		return func(line []byte) []byte { return line }
+	}
+	g := &goComments{}
+	return g.line
+}
@@ -0,0 +1,37 @@
+package tagpipe
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCountTagCommentsOnly(t *testing.T) {
+	const src = `package main
+
+// TODO: one in a line comment
+func main() {
+	s := "TODO: not in a string"
+	r := ` + "`TODO: nor a raw" + `
+TODO string` + "`" + `
+	/* a block TODO
+	   and another TODO */ println(s, r, 'T') // TODO
+}
+`
+	opts := []Option{WithSyntax(SyntaxPlain), WithWholeWord(true), WithTrimCutset(":\"`")}
+
+	n, err := CountTag(strings.NewReader(src), "TODO", append(opts, WithCommentsOnly(true))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("count in comments = %d, want 4", n)
+	}
+
+	n, err = CountTag(strings.NewReader(src), "TODO", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Errorf("count everywhere = %d, want 7", n)
+	}
+}
@@ -0,0 +1,176 @@
+package tagpipe
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+)
+
+// externalSortChunk is the number of tag counts sorted in memory at once by
+// SortTagCountsExternal, a var so tests can merge chunks of small inputs
+var externalSortChunk = 1 << 20
+
+// sortsBefore reports whether a sorts before b: higher counts first, ties by
+// tag so the order is deterministic
+func sortsBefore(a, b T) bool {
+	if a.Count != b.Count {
+		return a.Count > b.Count
+	}
+	return a.Tag < b.Tag
+}
+
+// SortTagCountsExternal sorts tag counts too many to sort in memory. It reads the
+// counts from input as JSON Lines, one T per line as json.Encoder writes them,
+// sorts chunks of them to temporary files in tmpDir, or the default directory
+// for temporary files if it's "", and merges those to output in the same
+// format, highest counts first. The temporary files are removed when it
+// returns.
+func SortTagCountsExternal(input io.Reader, output io.Writer, tmpDir string) error {
+	var chunks []string
+	defer func() {
+		for _, name := range chunks {
+			os.Remove(name)
+		}
+	}()
+
+	var chunk TList
+	flush := func() error {
+		sort.Slice(chunk, func(i, j int) bool { return sortsBefore(chunk[i], chunk[j]) })
+		f, err := os.CreateTemp(tmpDir, "tagcounts-*")
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, f.Name())
+
+		if err := writeTagCounts(f, chunk); err != nil {
+			f.Close()
+			return err
+		}
+		chunk = chunk[:0]
+		return f.Close()
+	}
+
+	dec := json.NewDecoder(input)
+	for {
+		var t T
+		err := dec.Decode(&t)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(chunk) == cap(chunk) {
+			// grow as needed rather than up front, so small inputs don't
+			// pay for a whole chunk, but never past one
+			grown := make(TList, len(chunk), min(max(2*cap(chunk), 1024), externalSortChunk))
+			copy(grown, chunk)
+			chunk = grown
+		}
+		chunk = append(chunk, t)
+		if len(chunk) == externalSortChunk {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// everything fit in one chunk, so there's nothing to merge
+	if len(chunks) == 0 {
+		sort.Slice(chunk, func(i, j int) bool { return sortsBefore(chunk[i], chunk[j]) })
+		return writeTagCounts(output, chunk)
+	}
+	if len(chunk) > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	return mergeTagCounts(chunks, output)
+}
+
+// writeTagCounts writes counts to w as JSON Lines
+func writeTagCounts(w io.Writer, counts TList) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, t := range counts {
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// mergeTagCounts merges the sorted chunk files named by chunks to w
+func mergeTagCounts(chunks []string, w io.Writer) error {
+	var h chunkHeap
+	for _, name := range chunks {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		c := &chunkReader{dec: json.NewDecoder(bufio.NewReader(f))}
+		ok, err := c.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, c)
+		}
+	}
+	heap.Init(&h)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for len(h) > 0 {
+		c := h[0]
+		if err := enc.Encode(c.t); err != nil {
+			return err
+		}
+
+		ok, err := c.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	return bw.Flush()
+}
+
+// chunkReader reads the tag counts of a sorted chunk file, t being the current one
+type chunkReader struct {
+	dec *json.Decoder
+	t   T
+}
+
+// next reads the next tag count into c.t, reporting false at the end of the chunk
+func (c *chunkReader) next() (bool, error) {
+	c.t = T{}
+	err := c.dec.Decode(&c.t)
+	if err == io.EOF {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// chunkHeap is a heap of chunk readers ordered by their current tag counts
+type chunkHeap []*chunkReader
+
+func (h chunkHeap) Len() int           { return len(h) }
+func (h chunkHeap) Less(i, j int) bool { return sortsBefore(h[i].t, h[j].t) }
+func (h chunkHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *chunkHeap) Push(x any)        { *h = append(*h, x.(*chunkReader)) }
+func (h *chunkHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,76 @@
+package tagpipe
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func TestSortTagCountsExternal(t *testing.T) {
+	defer func(n int) { externalSortChunk = n }(externalSortChunk)
+	externalSortChunk = 1000 // so 20000 counts are merged from many chunks
+
+	rng := rand.New(rand.NewSource(1))
+	counts := make(TList, 20000)
+	for i := range counts {
+		counts[i] = T{fmt.Sprintf("tag%05d", i), rng.Intn(500)}
+	}
+	var input bytes.Buffer
+	if err := writeTagCounts(&input, counts); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir := t.TempDir()
+	var output bytes.Buffer
+	if err := SortTagCountsExternal(&input, &output, tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	var got TList
+	dec := json.NewDecoder(&output)
+	for dec.More() {
+		var tc T
+		if err := dec.Decode(&tc); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, tc)
+	}
+	want := append(TList(nil), counts...)
+	sort.Slice(want, func(i, j int) bool { return sortsBefore(want[i], want[j]) })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sorted %d counts, want %d in order", len(got), len(want))
+	}
+
+	if left, err := os.ReadDir(tmpDir); err != nil || len(left) != 0 {
+		t.Errorf("temporary files left: %v, %v", left, err)
+	}
+}
+
+func TestSortTagCountsExternalSmallInput(t *testing.T) {
+	var input bytes.Buffer
+	if err := writeTagCounts(&input, TList{{"go", 1}, {"zig", 3}, {"rust", 3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var output bytes.Buffer
+	if err := SortTagCountsExternal(&input, &output, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+
+	if want := "{\"Tag\":\"rust\",\"Count\":3}\n{\"Tag\":\"zig\",\"Count\":3}\n{\"Tag\":\"go\",\"Count\":1}\n"; output.String() != want {
+		t.Errorf("output = %q, want %q", output.String(), want)
+	}
+	// a whole chunk would be tens of MB
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("allocated %d bytes sorting 3 counts", alloc)
+	}
+}
@@ -0,0 +1,80 @@
+package tagpipe
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ChangedFilesTagCount counts tag in each file of the git repository at repo
+// changed between baseRef and headRef, as listed by git diff, for checks that
+// only look at what a change touched. Files deleted by the change are left
+// out. The files are read from the working tree, so headRef would usually be
+// what's checked out. Results are keyed by paths relative to repo, with
+// forward slashes, as git lists them. Each ref must name a commit; refs
+// starting with "-", which git would take for options, are refused.
+func ChangedFilesTagCount(repo, baseRef, headRef, tag string, opts ...Option) (map[string]int, error) {
+	base, err := resolveCommit(repo, baseRef)
+	if err != nil {
+		return nil, err
+	}
+	head, err := resolveCommit(repo, headRef)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := git(repo, "diff", "--name-only", "-z", "--no-renames", "--diff-filter=d", "--end-of-options", base+".."+head, "--")
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := make(map[string]string) // git paths by file path
+	var paths []string
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name == "" {
+			continue
+		}
+		path := filepath.Join(repo, filepath.FromSlash(name))
+		byPath[path] = name
+		paths = append(paths, path)
+	}
+
+	counts, err := CountTagsInFiles(paths, tag, digesterCount(len(paths)), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]int, len(counts))
+	for path, n := range counts {
+		m[byPath[path]] = n
+	}
+	return m, nil
+}
+
+// resolveCommit returns the hash of the commit ref names in the git repository
+// at repo
+func resolveCommit(repo, ref string) (string, error) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return "", fmt.Errorf("invalid git ref %q", ref)
+	}
+	out, err := git(repo, "rev-parse", "--verify", "--quiet", "--end-of-options", ref+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("git ref %q is not a commit: %w", ref, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// git runs git on the repository at repo with args, returning what it writes to
+// stdout, or an error with what it writes to stderr
+func git(repo string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
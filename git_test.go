@@ -0,0 +1,106 @@
+package tagpipe
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// gitRepo makes a git repository in a new temporary directory, returning it
+// along with a function running git in it
+func gitRepo(t *testing.T) (string, func(args ...string)) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	repo := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL="+os.DevNull, "GIT_CONFIG_NOSYSTEM=1",
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	return repo, git
+}
+
+func TestChangedFilesTagCount(t *testing.T) {
+	repo, git := gitRepo(t)
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(repo, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("changed.json", `["go"]`)
+	write("deleted.json", `["go"]`)
+	write("same.json", `["go"]`)
+	write("old.json", `["go", "rust"]`)
+	git("add", "-A")
+	git("commit", "-q", "-m", "base")
+	git("tag", "base")
+
+	write("changed.json", `["go", "go"]`)
+	write("sub/added.json", `["rust"]`)
+	os.Remove(filepath.Join(repo, "deleted.json"))
+	os.Rename(filepath.Join(repo, "old.json"), filepath.Join(repo, "renamed.json"))
+	git("add", "-A")
+	git("commit", "-q", "-m", "head")
+
+	got, err := ChangedFilesTagCount(repo, "base", "HEAD", "go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a rename deletes the old path and adds the new one
+	want := map[string]int{"changed.json": 2, "sub/added.json": 0, "renamed.json": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("counts = %v, want %v", got, want)
+	}
+
+	got, err = ChangedFilesTagCount(repo, "HEAD", "HEAD", "go")
+	if err != nil || len(got) != 0 {
+		t.Errorf("no changes: counts = %v, %v, want none", got, err)
+	}
+
+	if _, err := ChangedFilesTagCount(repo, "missing", "HEAD", "go"); err == nil {
+		t.Error("unknown ref: no error")
+	}
+}
+
+func TestChangedFilesTagCountRefsAreNotOptions(t *testing.T) {
+	repo, git := gitRepo(t)
+	if err := os.WriteFile(filepath.Join(repo, "a.json"), []byte(`["go"]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "-A")
+	git("commit", "-q", "-m", "base")
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	for _, refs := range [][2]string{
+		{"--output=" + out, "HEAD"},
+		{"HEAD", "--output=" + out},
+		{"-p", "HEAD"},
+		{"", "HEAD"},
+		{"HEAD^{tree}", "HEAD"},
+	} {
+		if got, err := ChangedFilesTagCount(repo, refs[0], refs[1], "go"); err == nil {
+			t.Errorf("refs %q: counts = %v, want an error", refs, got)
+		}
+	}
+	// git diff would write to the path up to "..", followed by the other ref
+	if written, err := os.ReadDir(dir); err != nil || len(written) > 0 {
+		t.Errorf("a ref was taken for an option writing %v: %v", written, err)
+	}
+}
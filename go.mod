@@ -0,0 +1,11 @@
+module github.com/keremgocen/tagpipe
+
+go 1.23
+
+require (
+	github.com/dlclark/regexp2 v1.11.0
+	github.com/santhosh-tekuri/jsonschema/v6 v6.0.3
+	golang.org/x/text v0.14.0
+	golang.org/x/time v0.5.0
+	google.golang.org/protobuf v1.36.6
+)
@@ -0,0 +1,38 @@
+package tagpipe
+
+import "sync"
+
+// fileSem bounds the number of files open for scanning at once across all calls
+// in the process. Nil means unlimited.
+var (
+	fileSemMu sync.Mutex
+	fileSem   chan struct{}
+)
+
+// SetMaxConcurrency caps the number of file operations in flight at once across
+// all concurrent calls of the package, whatever their own worker counts. Calls
+// wait for a slot before opening a file and free it when they close it. n < 1
+// removes the cap. Operations already in flight keep the slots they hold.
+func SetMaxConcurrency(n int) {
+	fileSemMu.Lock()
+	defer fileSemMu.Unlock()
+	if n < 1 {
+		fileSem = nil
+		return
+	}
+	fileSem = make(chan struct{}, n)
+}
+
+// acquireFile waits for a slot to operate on a file and returns the func that
+// frees it, which must be called exactly once
+func acquireFile() (release func()) {
+	fileSemMu.Lock()
+	sem := fileSem
+	fileSemMu.Unlock()
+	if sem == nil {
+		return func() {}
+	}
+
+	sem <- struct{}{}
+	return func() { <-sem }
+}
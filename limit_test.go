@@ -0,0 +1,89 @@
+package tagpipe
+
+import (
+	"fmt"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// openCountingFS tracks the files open at once, and the most ever open
+type openCountingFS struct {
+	fstest.MapFS
+	open, peak atomic.Int64
+}
+
+func (c *openCountingFS) Open(name string) (fs.File, error) {
+	f, err := c.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Stat(); err == nil && name != "." {
+		n := c.open.Add(1)
+		for p := c.peak.Load(); n > p && !c.peak.CompareAndSwap(p, n); p = c.peak.Load() {
+		}
+		return &openCountedFile{File: f, c: c}, nil
+	}
+	return f, nil
+}
+
+type openCountedFile struct {
+	fs.File
+	c    *openCountingFS
+	once sync.Once
+}
+
+func (f *openCountedFile) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond) // hold the file open long enough to overlap
+	return f.File.Read(p)
+}
+
+func (f *openCountedFile) Close() error {
+	f.once.Do(func() { f.c.open.Add(-1) })
+	return f.File.Close()
+}
+
+// Run with -race, as the scans share the package wide limit
+func TestSetMaxConcurrency(t *testing.T) {
+	const max = 3
+	SetMaxConcurrency(max)
+	defer SetMaxConcurrency(0)
+
+	fsys := &openCountingFS{MapFS: fstest.MapFS{}}
+	for i := 0; i < 40; i++ {
+		fsys.MapFS[fmt.Sprintf("d%d/%d.json", i%4, i)] = &fstest.MapFile{Data: []byte(`["go"]`)}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if i%2 == 0 {
+				_, err = MD5All(".", WithFS(fsys))
+			} else {
+				_, _, err = CountTagDetailed(".", "go", WithFS(fsys))
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if peak := fsys.peak.Load(); peak > max || peak == 0 {
+		t.Errorf("at most %d files open at once, want between 1 and %d", peak, max)
+	}
+	if n := fsys.open.Load(); n != 0 {
+		t.Errorf("%d files left open", n)
+	}
+}
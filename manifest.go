@@ -0,0 +1,173 @@
+package tagpipe
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// VerifyTree walks the file tree rooted at root and compares it to manifest, the
+// result of a previous MD5All. It returns the paths of files that are new, that
+// are missing and whose contents changed since, each sorted.
+func VerifyTree(root string, manifest map[string][md5.Size]byte, opts ...Option) (added, removed, changed []string, err error) {
+	current, err := MD5All(root, opts...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for path, sum := range current {
+		old, ok := manifest[path]
+		switch {
+		case !ok:
+			added = append(added, path)
+		case old != sum:
+			changed = append(changed, path)
+		}
+	}
+	for path := range manifest {
+		if _, ok := current[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed, nil
+}
+
+// ManifestFormat is a line format of md5sum manifests
+type ManifestFormat int
+
+// Formats written by WriteManifest
+const (
+	ManifestGNU ManifestFormat = iota // "hexdigest  path", as GNU md5sum writes
+	ManifestBSD                       // "MD5 (path) = hexdigest", as BSD md5 and md5sum --tag write
+)
+
+// WriteManifest writes the sums in m, as returned by MD5All, to w as a manifest
+// in the given format, sorted by path, so it can be checked with md5sum -c.
+// Like md5sum, lines of paths containing a backslash or a newline start with a
+// backslash and have them escaped.
+func WriteManifest(w io.Writer, m map[string][md5.Size]byte, format ManifestFormat) error {
+	if format != ManifestGNU && format != ManifestBSD {
+		return fmt.Errorf("unknown manifest format %d", format)
+	}
+
+	paths := make([]string, 0, len(m))
+	for path := range m {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	bw := bufio.NewWriter(w)
+	for _, path := range paths {
+		sum := m[path]
+		prefix, escaped := "", manifestEscaper.Replace(path)
+		if escaped != path {
+			prefix = "\\"
+		}
+
+		if format == ManifestGNU {
+			fmt.Fprintf(bw, "%s%s  %s\n", prefix, hex.EncodeToString(sum[:]), escaped)
+		} else {
+			fmt.Fprintf(bw, "%sMD5 (%s) = %s\n", prefix, escaped, hex.EncodeToString(sum[:]))
+		}
+	}
+	return bw.Flush()
+}
+
+// manifestEscaper escapes paths in manifest lines as md5sum does
+var manifestEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+
+// ParseManifest reads a manifest in either format WriteManifest writes, lines
+// of which may mix, into the sums by path it lists. A "*" before a GNU path,
+// marking it read in binary mode, is dropped. Blank lines are skipped, and any
+// other line that isn't a manifest entry is an error reporting its number.
+func ParseManifest(r io.Reader) (map[string][md5.Size]byte, error) {
+	m := make(map[string][md5.Size]byte)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSuffix(s.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		path, sum, ok := parseManifestLine(line)
+		if !ok {
+			return nil, fmt.Errorf("manifest line %d: malformed entry %q", n, line)
+		}
+		m[path] = sum
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parseManifestLine parses a GNU or BSD manifest line, unescaping its path
+func parseManifestLine(line string) (string, [md5.Size]byte, bool) {
+	var sum [md5.Size]byte
+	line, escaped := strings.CutPrefix(line, "\\")
+
+	var path, digest string
+	if rest, ok := strings.CutPrefix(line, "MD5 ("); ok {
+		i := strings.LastIndex(rest, ") = ")
+		if i < 0 {
+			return "", sum, false
+		}
+		path, digest = rest[:i], rest[i+len(") = "):]
+	} else {
+		if len(line) < 2*md5.Size+2 || line[2*md5.Size] != ' ' {
+			return "", sum, false
+		}
+		if c := line[2*md5.Size+1]; c != ' ' && c != '*' {
+			return "", sum, false
+		}
+		digest, path = line[:2*md5.Size], line[2*md5.Size+2:]
+	}
+
+	if len(digest) != 2*md5.Size || path == "" {
+		return "", sum, false
+	}
+	if _, err := hex.Decode(sum[:], []byte(digest)); err != nil {
+		return "", sum, false
+	}
+	if escaped {
+		var ok bool
+		if path, ok = unescapeManifestPath(path); !ok {
+			return "", sum, false
+		}
+	}
+	return path, sum, true
+}
+
+// unescapeManifestPath reverses manifestEscaper, reporting false for an escape
+// it doesn't write
+func unescapeManifestPath(path string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] != '\\' {
+			b.WriteByte(path[i])
+			continue
+		}
+		if i++; i == len(path) {
+			return "", false
+		}
+		switch path[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			return "", false
+		}
+	}
+	return b.String(), true
+}
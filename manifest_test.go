@@ -0,0 +1,201 @@
+package tagpipe
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVerifyTree(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"same.json":        `["go"]`,
+		"changed.json":     `["go"]`,
+		"removed.json":     `["rust"]`,
+		"sub/removed.json": `{}`,
+	})
+	manifest, err := MD5All(root, WithRelativePaths(true), WithNormalizeSlashes(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "changed.json"), []byte(`["rust"]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "removed.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"added.json", "new/added.json"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	added, removed, changed, err := VerifyTree(root, manifest, WithRelativePaths(true), WithNormalizeSlashes(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"added.json", "new/added.json"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("added = %q, want %q", added, want)
+	}
+	if want := []string{"removed.json", "sub/removed.json"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed = %q, want %q", removed, want)
+	}
+	if want := []string{"changed.json"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed = %q, want %q", changed, want)
+	}
+}
+
+func TestVerifyTreeUnchanged(t *testing.T) {
+	root := writeTree(t, map[string]string{"a.json": `["go"]`, "sub/b.json": `{}`})
+	manifest, err := MD5All(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added, removed, changed, err := VerifyTree(root, manifest)
+	if err != nil || added != nil || removed != nil || changed != nil {
+		t.Errorf("VerifyTree = %q, %q, %q, %v, want no differences", added, removed, changed, err)
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	m := map[string][md5.Size]byte{
+		"b.json":        md5.Sum([]byte(`["go"]`)),
+		"a.json":        md5.Sum([]byte(`[]`)),
+		"sub/c d.json":  md5.Sum([]byte(`{}`)),
+		"back\\sl.json": md5.Sum(nil),
+		"new\nline":     md5.Sum([]byte("x")),
+	}
+	hexSum := func(path string) string {
+		sum := m[path]
+		return hex.EncodeToString(sum[:])
+	}
+
+	var buf bytes.Buffer
+	if err := WriteManifest(&buf, m, ManifestGNU); err != nil {
+		t.Fatal(err)
+	}
+	want := hexSum("a.json") + "  a.json\n" +
+		hexSum("b.json") + "  b.json\n" +
+		"\\" + hexSum("back\\sl.json") + "  back\\\\sl.json\n" +
+		"\\" + hexSum("new\nline") + "  new\\nline\n" +
+		hexSum("sub/c d.json") + "  sub/c d.json\n"
+	if got := buf.String(); got != want {
+		t.Errorf("GNU manifest =\n%s\nwant\n%s", got, want)
+	}
+	got, err := ParseManifest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("parsed GNU manifest = %x, want %x", got, m)
+	}
+
+	buf.Reset()
+	if err := WriteManifest(&buf, m, ManifestBSD); err != nil {
+		t.Fatal(err)
+	}
+	if line := "MD5 (sub/c d.json) = " + hexSum("sub/c d.json") + "\n"; !strings.HasSuffix(buf.String(), line) {
+		t.Errorf("BSD manifest =\n%s\nwant it to end with %q", buf.String(), line)
+	}
+	if got, err := ParseManifest(&buf); err != nil || !reflect.DeepEqual(got, m) {
+		t.Errorf("parsed BSD manifest = %x, %v, want %x", got, err, m)
+	}
+
+	if err := WriteManifest(&buf, m, ManifestFormat(2)); err == nil {
+		t.Error("unknown format: no error")
+	}
+}
+
+func TestWriteManifestMD5Sum(t *testing.T) {
+	md5sum, err := exec.LookPath("md5sum")
+	if err != nil {
+		t.Skip("md5sum not found")
+	}
+	root := writeTree(t, map[string]string{"a.json": `["go"]`, "sub/b c.json": `[]`, "back\\sl.json": `{}`})
+	m, err := MD5All(root, WithRelativePaths(true), WithNormalizeSlashes(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []ManifestFormat{ManifestGNU, ManifestBSD} {
+		var buf bytes.Buffer
+		if err := WriteManifest(&buf, m, format); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(md5sum, "-c", "--strict", "-")
+		cmd.Dir, cmd.Stdin = root, &buf
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("format %d: md5sum -c: %v: %s", format, err, out)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	a, b := md5.Sum([]byte("a")), md5.Sum([]byte("b"))
+	ha, hb := hex.EncodeToString(a[:]), hex.EncodeToString(b[:])
+
+	tests := []struct {
+		name     string
+		manifest string
+		want     map[string][md5.Size]byte
+	}{
+		{"GNU", ha + "  a.json\n" + hb + "  sub/b c.json\n", map[string][md5.Size]byte{"a.json": a, "sub/b c.json": b}},
+		{"GNU binary marker", ha + " *a.json\n", map[string][md5.Size]byte{"a.json": a}},
+		{"BSD", "MD5 (a.json) = " + ha + "\nMD5 (x) = y.json) = " + hb + "\n", map[string][md5.Size]byte{"a.json": a, "x) = y.json": b}},
+		{"mixed, CRLF and blank lines", ha + "  a.json\r\n\r\n  \nMD5 (b.json) = " + hb + "\r\n", map[string][md5.Size]byte{"a.json": a, "b.json": b}},
+		{"escaped", "\\" + ha + "  new\\nline\\\\.json\n\\MD5 (cr\\r) = " + hb, map[string][md5.Size]byte{"new\nline\\.json": a, "cr\r": b}},
+		{"upper case digest", strings.ToUpper(ha) + "  a.json\n", map[string][md5.Size]byte{"a.json": a}},
+		{"empty", "", map[string][md5.Size]byte{}},
+	}
+	for _, tt := range tests {
+		got, err := ParseManifest(strings.NewReader(tt.manifest))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sums = %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseManifestMalformed(t *testing.T) {
+	sum := md5.Sum([]byte("a"))
+	ha := hex.EncodeToString(sum[:])
+
+	for _, line := range []string{
+		"not a manifest line",
+		ha + " a.json",             // one space
+		ha + "  ",                  // no path
+		ha[1:] + "  a.json",        // short digest
+		"zz" + ha[2:] + "  a.json", // not hex
+		"MD5 (a.json) " + ha,       // no " = "
+		"MD5 (a.json) = " + ha[2:],
+		"SHA1 (a.json) = " + ha,
+		"\\" + ha + "  a\\t.json", // unknown escape
+		"\\" + ha + "  a.json\\",  // trailing backslash
+	} {
+		_, err := ParseManifest(strings.NewReader(ha + "  ok.json\n\n" + line + "\n"))
+		if err == nil {
+			t.Errorf("%q: no error", line)
+			continue
+		}
+		if want := "manifest line 3: "; !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%q: err = %v, want it to start with %q", line, err, want)
+		}
+	}
+}
@@ -0,0 +1,790 @@
+package tagpipe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TagSyntax is the way tags are written in files
+type TagSyntax int
+
+// Syntaxes supported by the matcher
+const (
+	SyntaxQuoted  TagSyntax = iota // "tag", as in JSON strings
+	SyntaxPlain                    // tag
+	SyntaxBracket                  // [tag]
+	SyntaxBrace                    // {{tag}}
+)
+
+// pattern returns a regexp pattern matching tag written in syntax s
+func (s TagSyntax) pattern(tag string) string {
+	var open, close string
+	switch s {
+	case SyntaxQuoted:
+		open, close = "\"", "\""
+	case SyntaxBracket:
+		open, close = "[", "]"
+	case SyntaxBrace:
+		open, close = "{{", "}}"
+	}
+	return regexp.QuoteMeta(open) + regexp.QuoteMeta(tag) + regexp.QuoteMeta(close)
+}
+
+// matcher returns the number of times a tag occurs in b
+type matcher func(b []byte) int
+
+// regexpCache holds the patterns compiled by one call, so that scanning a tree
+// compiles the pattern of each tag once rather than once per file, while
+// nothing outlives the call. Flags are part of a Go pattern, as in "(?i)tag",
+// so the pattern alone is the key. A compiled Regexp is safe for concurrent
+// use, so it's shared by all the digesters. A cache outliving calls, as a
+// Scanner's does, sets max, and is emptied when it's full.
+type regexpCache struct {
+	mu  sync.Mutex
+	m   map[string]*regexp.Regexp
+	max int // patterns held at most, unbounded if 0
+}
+
+// compile is regexp.Compile backed by the cache, or not cached if c is nil
+func (c *regexpCache) compile(pattern string) (*regexp.Regexp, error) {
+	if c == nil {
+		return regexp.Compile(pattern)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if re, ok := c.m[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if c.m == nil || (c.max > 0 && len(c.m) >= c.max) {
+		c.m = make(map[string]*regexp.Regexp)
+	}
+	c.m[pattern] = re
+	return re, nil
+}
+
+// ErrEmptyTag is the error of a tag that's empty or only whitespace
+var ErrEmptyTag = errors.New("empty tag")
+
+// NormalizeTag returns tag without leading and trailing whitespace, which would
+// otherwise quietly keep it from matching, or ErrEmptyTag if nothing's left.
+// The counters normalize the tags they're given with it.
+func NormalizeTag(tag string) (string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return "", ErrEmptyTag
+	}
+	return tag, nil
+}
+
+// normalizeTags returns tags as the counts of them are keyed: normalized with
+// NormalizeTag, in lower case when o has IgnoreCase and NormalizeKeys, and
+// without the duplicates that makes. The counters normalize tags once, before
+// scanning, and key everything they report by what it returns.
+func normalizeTags(tags []string, o *Options) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	norm := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag, err := NormalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if o.IgnoreCase && o.NormalizeKeys {
+			tag = strings.ToLower(tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			norm = append(norm, tag)
+		}
+	}
+	return norm, nil
+}
+
+// newMatcher builds the matcher for tag. By default it counts occurrences of tag
+// written in the configured syntax, while in WholeWord mode it counts the words
+// equal to tag once TrimCutset is trimmed from them.
+func newMatcher(tag string, o *Options) (matcher, error) {
+	tag, err := NormalizeTag(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.WholeWord {
+		t := []byte(tag)
+		equal := bytes.Equal
+		if o.IgnoreCase {
+			equal = bytes.EqualFold
+		}
+		countLine := func(line []byte) int {
+			words := bytes.Fields(line)
+			if len(words) > 1 {
+				switch {
+				case o.AnchorStart && o.AnchorEnd:
+					// the tag would have to be the whole line
+					return 0
+				case o.AnchorStart:
+					words = words[:1]
+				case o.AnchorEnd:
+					words = words[len(words)-1:]
+				}
+			}
+
+			n := 0
+			prev := false // whether the previous word matched
+			for _, w := range words {
+				m := equal(bytes.Trim(w, o.TrimCutset), t)
+				if m && !(prev && o.CollapseRuns) {
+					n++
+				}
+				prev = m
+			}
+			return n
+		}
+		// line by line, as b holds all lines in WholeFile mode
+		return func(b []byte) int {
+			n := 0
+			for len(b) > 0 {
+				line, rest, _ := bytes.Cut(b, []byte("\n"))
+				n += countLine(line)
+				b = rest
+			}
+			return n
+		}, nil
+	}
+
+	pattern := o.Syntax.pattern(tag)
+	if o.AnchorStart {
+		pattern = "^" + pattern
+	}
+	if o.AnchorEnd {
+		// before "\r\n" line endings too, which whole files keep
+		pattern += `(?:\r?$)`
+	}
+	// multi-line, so anchors work at line ends when matching whole files
+	flags := "m"
+	if o.IgnoreCase {
+		flags += "i"
+	}
+	re, err := o.regexps.compile("(?" + flags + ")" + pattern)
+	if err != nil {
+		return nil, err
+	}
+	if o.Overlapping && !o.AnchorStart && !o.AnchorEnd {
+		return func(b []byte) int {
+			n := 0
+			for pos := 0; pos < len(b); {
+				loc := re.FindIndex(b[pos:])
+				if loc == nil {
+					break
+				}
+				n++
+				// resume one character after the start of the match
+				_, size := utf8.DecodeRune(b[pos+loc[0]:])
+				pos += loc[0] + size
+			}
+			return n
+		}, nil
+	}
+	if o.CollapseRuns {
+		return func(b []byte) int {
+			n := 0
+			end := -1 // of the previous match
+			for _, loc := range re.FindAllIndex(b, -1) {
+				// runs end at line ends, even matching a whole file at once
+				if end < 0 || len(bytes.TrimSpace(b[end:loc[0]])) > 0 || bytes.IndexByte(b[end:loc[0]], '\n') >= 0 {
+					n++
+				}
+				end = loc[1]
+			}
+			return n
+		}, nil
+	}
+	return func(b []byte) int {
+		return len(re.FindAllIndex(b, -1))
+	}, nil
+}
+
+// CountTag reads r line by line and returns the number of occurrences of tag,
+// matched according to opts
+func CountTag(r io.Reader, tag string, opts ...Option) (int, error) {
+	return countReader(r, tag, newOptions(opts))
+}
+
+// countReader is CountTag with options already applied
+func countReader(r io.Reader, tag string, o *Options) (int, error) {
+	match, err := newMatcher(tag, o)
+	if err != nil {
+		return 0, err
+	}
+
+	if o.WholeFile && !o.CommentsOnly && !o.DistinctLines {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return 0, err
+		}
+		return match(bytes.TrimPrefix(data, utf8BOM)), nil
+	}
+
+	filter := newLineFilter(o)
+	br, release := o.readBuffer(r)
+	defer release()
+	r = br
+
+	n := 0
+	if !o.DistinctLines {
+		err := eachLine(r, func(line []byte) error {
+			n += match(filter(line))
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+
+	// only keep the sum of each line, to bound memory on large inputs
+	seen := make(map[[md5.Size]byte]struct{})
+	err = eachLine(r, func(line []byte) error {
+		line = filter(line)
+		if match(line) > 0 {
+			seen[md5.Sum(line)] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(seen), nil
+}
+
+// EnglishStopwords are common English words, for use with WithStopwords
+var EnglishStopwords = []string{
+	"a", "about", "after", "all", "also", "an", "and", "any", "are", "as", "at",
+	"be", "because", "been", "but", "by", "can", "could", "did", "do", "does",
+	"for", "from", "had", "has", "have", "he", "her", "him", "his", "how", "i",
+	"if", "in", "into", "is", "it", "its", "just", "me", "more", "my", "no",
+	"not", "of", "on", "only", "or", "other", "our", "out", "over", "she", "so",
+	"some", "such", "than", "that", "the", "their", "them", "then", "there",
+	"these", "they", "this", "to", "up", "us", "was", "we", "were", "what",
+	"when", "which", "who", "will", "with", "would", "you", "your",
+}
+
+// WordFrequency reads r line by line and counts every distinct word in it, words
+// being runs of Unicode letters and digits. With IgnoreCase set words are
+// counted in lower case, so "The" and "the" are one word. Stopwords are left out.
+func WordFrequency(r io.Reader, opts ...Option) (map[string]int, error) {
+	o := newOptions(opts)
+	notWord := func(c rune) bool { return !unicode.IsLetter(c) && !unicode.IsDigit(c) }
+
+	stop := make(map[string]bool, len(o.Stopwords))
+	for _, w := range o.Stopwords {
+		if o.IgnoreCase {
+			w = strings.ToLower(w)
+		}
+		stop[w] = true
+	}
+
+	counts := make(map[string]int)
+	err := eachLine(r, func(line []byte) error {
+		for _, w := range bytes.FieldsFunc(line, notWord) {
+			if utf8.RuneCount(w) < o.MinWordLength {
+				continue
+			}
+			if o.IgnoreCase {
+				w = bytes.ToLower(w)
+			}
+			if stop[string(w)] {
+				continue
+			}
+			counts[string(w)]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// MatchWithContext is a line containing a tag along with the lines around it
+type MatchWithContext struct {
+	Line   int // 1-based line number
+	Text   string
+	Before []string
+	After  []string
+}
+
+// GrepTagContext reads r line by line and returns the lines containing tag, as
+// matched according to opts, with up to before lines preceding and after lines
+// following each, like grep -B and -A. A line is only ever given once: context
+// stops at the next matching line, and lines already after one match aren't
+// repeated before the next, so the results read back as grep's merged groups.
+func GrepTagContext(r io.Reader, tag string, before, after int, opts ...Option) ([]MatchWithContext, error) {
+	o := newOptions(opts)
+	match, err := newMatcher(tag, o)
+	if err != nil {
+		return nil, err
+	}
+	filter := newLineFilter(o)
+
+	var matches []MatchWithContext
+	var prev []string // lines since the last match that may come before the next
+	afterLeft := 0
+	n := 0
+	err = eachLine(r, func(line []byte) error {
+		n++
+		text := string(line)
+		switch {
+		case match(filter(line)) > 0:
+			matches = append(matches, MatchWithContext{Line: n, Text: text, Before: prev})
+			prev = nil
+			afterLeft = after
+		case afterLeft > 0:
+			m := &matches[len(matches)-1]
+			m.After = append(m.After, text)
+			afterLeft--
+		case before > 0:
+			if len(prev) == before {
+				prev = prev[1:]
+			}
+			prev = append(prev, text)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// TagSpec is a tag along with how to match it, for counting tags matched in
+// different ways at once
+type TagSpec struct {
+	Tag        string
+	WholeWord  bool
+	IgnoreCase bool
+}
+
+// CountTagSpecs reads r line by line, once, and returns the number of occurrences
+// of the tag of each of specs, matched according to opts except for the
+// settings in its spec, e.g. "go" as a whole word along with "c++" anywhere.
+// The returned map holds a count for every tag in specs. It's an error for two
+// specs to have the same tag, as their counts couldn't be told apart.
+func CountTagSpecs(r io.Reader, specs []TagSpec, opts ...Option) (map[string]int, error) {
+	o := newOptions(opts)
+	matchers := make([]matcher, len(specs))
+	tags := make([]string, len(specs))
+	counts := make(map[string]int, len(specs))
+	for i, spec := range specs {
+		tag, err := NormalizeTag(spec.Tag)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := counts[tag]; ok {
+			return nil, fmt.Errorf("tag %q specified more than once", tag)
+		}
+		so := *o
+		so.WholeWord, so.IgnoreCase = spec.WholeWord, spec.IgnoreCase
+		match, err := newMatcher(tag, &so)
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = match
+		tags[i] = tag
+		counts[tag] = 0
+	}
+
+	filter := newLineFilter(o)
+	err := eachLine(r, func(line []byte) error {
+		line = filter(line)
+		for i, match := range matchers {
+			counts[tags[i]] += match(line)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// TagRange reads r line by line and returns the number of occurrences of tag,
+// matched according to opts, along with the 1-based numbers of the first and
+// last lines it occurs on, which are 0 when it doesn't occur
+func TagRange(r io.Reader, tag string, opts ...Option) (count, firstLine, lastLine int, err error) {
+	o := newOptions(opts)
+	match, err := newMatcher(tag, o)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	filter := newLineFilter(o)
+
+	n := 0
+	err = eachLine(r, func(line []byte) error {
+		n++
+		if m := match(filter(line)); m > 0 {
+			count += m
+			if firstLine == 0 {
+				firstLine = n
+			}
+			lastLine = n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return count, firstLine, lastLine, nil
+}
+
+// ScanLines reads r line by line and calls onMatch with the 1-based number and the
+// text of each line where tag occurs, matched according to opts, as soon as
+// it's read. Calls are made in order from the calling goroutine, never at once.
+func ScanLines(r io.Reader, tag string, onMatch func(lineNum int, line string), opts ...Option) error {
+	o := newOptions(opts)
+	match, err := newMatcher(tag, o)
+	if err != nil {
+		return err
+	}
+	filter := newLineFilter(o)
+
+	n := 0
+	return eachLine(r, func(line []byte) error {
+		n++
+		if match(filter(line)) > 0 {
+			onMatch(n, string(line))
+		}
+		return nil
+	})
+}
+
+// CountTagParallel is like CountTag over the file at path, but splits the file in
+// up to workers chunks on line boundaries and counts them in parallel, to make
+// use of more cores on a few huge files. The chunks are read directly from the
+// file, so ReadRateLimit is the only reading option that applies. DistinctLines
+// can't be split and is counted by a single worker.
+func CountTagParallel(path, tag string, workers int, opts ...Option) (int, error) {
+	o := newOptions(opts)
+	if workers < 1 || o.DistinctLines {
+		workers = 1
+	}
+
+	// the workers share one file, so they hold a single slot
+	release := acquireFile()
+	defer release()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	// align the nominal chunk offsets to the start of the next line
+	offsets := []int64{0}
+	for i := 1; i < workers; i++ {
+		off, err := lineStart(f, size*int64(i)/int64(workers), size)
+		if err != nil {
+			return 0, err
+		}
+		if off > offsets[len(offsets)-1] {
+			offsets = append(offsets, off)
+		}
+	}
+	offsets = append(offsets, size)
+
+	counts := make([]int, len(offsets)-1)
+	errs := make([]error, len(offsets)-1)
+	var wg sync.WaitGroup
+	wg.Add(len(counts))
+	for i := range counts {
+		go func(i int) {
+			defer wg.Done()
+			var r io.Reader = io.NewSectionReader(f, offsets[i], offsets[i+1]-offsets[i])
+			if o.limiter != nil {
+				r = &rateLimitedReader{r: r, l: o.limiter}
+			}
+			counts[i], errs[i] = countReader(r, tag, o)
+		}(i)
+	}
+	wg.Wait()
+
+	n := 0
+	for i := range counts {
+		if errs[i] != nil {
+			return 0, errs[i]
+		}
+		n += counts[i]
+	}
+	return n, nil
+}
+
+// lineStart returns the offset of the first line of f starting at or after off
+func lineStart(f io.ReaderAt, off, size int64) (int64, error) {
+	if off == 0 {
+		return 0, nil
+	}
+
+	buf := make([]byte, 4096)
+	for pos := off - 1; pos < size; {
+		n, err := f.ReadAt(buf, pos)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+		pos += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// CountPatterns reads r line by line, once, and counts the matches of each of the
+// named patterns. The returned map holds a count for every name in patterns.
+// With Multiline set, patterns that can span lines are matched over all of r.
+func CountPatterns(r io.Reader, patterns map[string]*regexp.Regexp, opts ...Option) (map[string]int, error) {
+	o := newOptions(opts)
+	counts := make(map[string]int, len(patterns))
+	lineRes := make(map[string]*regexp.Regexp, len(patterns))
+	for name, re := range patterns {
+		counts[name] = 0
+		if !o.Multiline || !matchesNewline(re) {
+			lineRes[name] = re
+		}
+	}
+
+	if len(lineRes) < len(patterns) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		data = bytes.TrimPrefix(data, utf8BOM)
+		for name, re := range patterns {
+			if _, ok := lineRes[name]; !ok {
+				counts[name] = len(re.FindAllIndex(data, -1))
+			}
+		}
+		r = bytes.NewReader(data)
+	}
+
+	err := eachLine(r, func(line []byte) error {
+		for name, re := range lineRes {
+			counts[name] += len(re.FindAllIndex(line, -1))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// matchesNewline reports whether re can match a newline, and so a match of it may
+// span lines
+func matchesNewline(re *regexp.Regexp) bool {
+	prog, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return true // can't tell, so play safe
+	}
+
+	var walk func(*syntax.Regexp) bool
+	walk = func(re *syntax.Regexp) bool {
+		switch re.Op {
+		case syntax.OpAnyChar:
+			return true
+		case syntax.OpLiteral:
+			return strings.ContainsRune(string(re.Rune), '\n')
+		case syntax.OpCharClass:
+			// Rune holds pairs of inclusive bounds
+			for i := 0; i+1 < len(re.Rune); i += 2 {
+				if re.Rune[i] <= '\n' && '\n' <= re.Rune[i+1] {
+					return true
+				}
+			}
+		}
+		for _, sub := range re.Sub {
+			if walk(sub) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(prog)
+}
+
+// CountAttributeValues tokenizes the HTML or XML read from r and counts the start
+// tags where attribute attr equals value, as in class="todo". Attribute names
+// are compared case-insensitively like HTML does, while values must match
+// exactly. Input is parsed leniently, allowing common HTML such as unclosed
+// and void elements.
+func CountAttributeValues(r io.Reader, attr, value string) (int, error) {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	n := 0
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		for _, a := range start.Attr {
+			if strings.EqualFold(a.Name.Local, attr) && a.Value == value {
+				n++
+				break
+			}
+		}
+	}
+}
+
+// CountJSONKey reads the JSON read from r as a stream of tokens and counts the
+// object keys equal to key, at any depth, including in objects inside arrays.
+// Repeated keys in an object are each counted. Several documents one after
+// the other, as in JSON Lines, are read as one. A leading byte order mark is
+// skipped.
+func CountJSONKey(r io.Reader, key string) (int, error) {
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(len(utf8BOM)); bytes.Equal(head, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+	d := json.NewDecoder(br)
+
+	// the objects and arrays open at the current token
+	type container struct {
+		object    bool
+		expectKey bool // an object's next string is a key
+	}
+	var open []container
+
+	n := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF && len(open) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			open = append(open, container{object: true, expectKey: true})
+			continue
+		case json.Delim('['):
+			open = append(open, container{})
+			continue
+		case json.Delim('}'), json.Delim(']'):
+			open = open[:len(open)-1]
+		default:
+			if len(open) > 0 && open[len(open)-1].expectKey {
+				if tok == key {
+					n++
+				}
+				open[len(open)-1].expectKey = false
+				continue
+			}
+		}
+
+		// a value ended, so an object holding it expects a key next
+		if len(open) > 0 && open[len(open)-1].object {
+			open[len(open)-1].expectKey = true
+		}
+	}
+}
+
+// errStop is returned by eachLine callbacks to stop reading early
+var errStop = errors.New("stop reading lines")
+
+// utf8BOM is the byte order mark some editors start UTF-8 files with
+var utf8BOM = []byte("\ufeff")
+
+// eachLine calls fn with every line of r, without its line ending. Unlike
+// bufio.Scanner there is no limit on line length, as JSON is often minified.
+// A leading byte order mark is dropped, so it can't stick to the first word.
+// The line passed to fn is only valid until fn returns. If fn returns an error
+// eachLine stops reading and returns it.
+func eachLine(r io.Reader, fn func(line []byte) error) error {
+	br := bufio.NewReader(r)
+	for first := true; ; first = false {
+		line, err := br.ReadBytes('\n')
+		if first {
+			line = bytes.TrimPrefix(line, utf8BOM)
+		}
+		if len(line) > 0 {
+			if ferr := fn(dropLineEnding(line)); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// scanLines sends every line of r on out, for consumers reading lines on another
+// goroutine. It closes out when it returns, so callers must not. It stops early
+// when ctx is done, returning ctx.Err(), or when reading fails.
+func scanLines(ctx context.Context, r io.Reader, out chan<- string) error {
+	defer close(out)
+
+	return eachLine(r, func(line []byte) error {
+		select {
+		case out <- string(line):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// dropLineEnding removes a trailing "\n" or "\r\n" from line
+func dropLineEnding(line []byte) []byte {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+	}
+	return line
+}
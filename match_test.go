@@ -0,0 +1,714 @@
+package tagpipe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCountPatterns(t *testing.T) {
+	input := `contact alice@example.com or bob@example.org
+call 555-1234 after 5
+no matches here
+carol@example.net, 555-9876 and 555-0000`
+	patterns := map[string]*regexp.Regexp{
+		"emails": regexp.MustCompile(`\w+@\w+\.\w+`),
+		"phones": regexp.MustCompile(`\d{3}-\d{4}`),
+		"urls":   regexp.MustCompile(`https?://\S+`),
+	}
+
+	got, err := CountPatterns(strings.NewReader(input), patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"emails": 3, "phones": 3, "urls": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CountPatterns = %v, want %v", got, want)
+	}
+}
+
+func TestCountTagTrimCutset(t *testing.T) {
+	input := `I write golang. Do you write "golang" too, or golang?`
+	tests := []struct {
+		cutset string
+		want   int
+	}{
+		{"", 0},
+		{`.`, 1},
+		{`."?`, 3},
+	}
+	for _, tt := range tests {
+		got, err := CountTag(strings.NewReader(input), "golang", WithWholeWord(true), WithTrimCutset(tt.cutset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("cutset %q: count = %d, want %d", tt.cutset, got, tt.want)
+		}
+	}
+}
+
+func TestCountTagDistinctLines(t *testing.T) {
+	input := `"todo" fix this
+"todo" fix this
+nothing here
+"todo" "todo" fix that
+"todo" fix this
+`
+	all, err := CountTag(strings.NewReader(input), "todo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	distinct, err := CountTag(strings.NewReader(input), "todo", WithDistinctLines(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all != 5 || distinct != 2 {
+		t.Errorf("counts = %d, %d distinct, want 5, 2 distinct", all, distinct)
+	}
+}
+
+// withRegexps has a call compile its patterns into c, for counting them
+func withRegexps(c *regexpCache) Option {
+	return func(o *Options) { o.regexps = c }
+}
+
+// manyFiles returns n files holding the tag "go" once, keyed by name
+func manyFiles(n int) map[string]string {
+	files := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		files[fmt.Sprintf("d%d/f%d.json", i%10, i)] = `{"lang": "go"}`
+	}
+	return files
+}
+
+func TestCompileOncePerTree(t *testing.T) {
+	root := writeTree(t, manyFiles(100))
+
+	var c regexpCache
+	total, _, err := CountTagDetailed(root, "go", withRegexps(&c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 100 {
+		t.Errorf("total = %d, want 100", total)
+	}
+	if n := len(c.m); n != 1 {
+		t.Errorf("%d patterns compiled, want 1", n)
+	}
+
+	re, err := c.compile(`(?m)"go"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := c.compile(`(?m)"go"`); again != re {
+		t.Error("pattern compiled again rather than taken from the cache")
+	}
+
+	// each call compiles into a cache of its own, dropped when it returns
+	if newOptions(nil).regexps == newOptions(nil).regexps {
+		t.Error("calls share a cache of compiled patterns")
+	}
+}
+
+// BenchmarkCountTagTree reports the patterns compiled per call, which stays 1
+// however many files are scanned
+func BenchmarkCountTagTree(b *testing.B) {
+	for _, n := range []int{10, 1000} {
+		b.Run(fmt.Sprintf("files=%d", n), func(b *testing.B) {
+			root := writeTree(b, manyFiles(n))
+			b.ResetTimer()
+			var c regexpCache
+			for i := 0; i < b.N; i++ {
+				c = regexpCache{}
+				if _, _, err := CountTagDetailed(root, "go", withRegexps(&c)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(c.m)), "patterns")
+		})
+	}
+}
+
+func TestCountTagSyntax(t *testing.T) {
+	doc := `[todo] write docs, {{todo}} in templates
+"todo" [todo] todo [c++] {{c++}}
+[todo]] {todo} [[todo]`
+	tests := []struct {
+		syntax TagSyntax
+		tag    string
+		want   int
+	}{
+		{SyntaxBracket, "todo", 4},
+		{SyntaxBrace, "todo", 1},
+		{SyntaxQuoted, "todo", 1},
+		{SyntaxPlain, "todo", 8},
+		{SyntaxBracket, "c++", 1},
+		{SyntaxBrace, "c++", 1},
+	}
+	for _, tt := range tests {
+		got, err := CountTag(strings.NewReader(doc), tt.tag, WithSyntax(tt.syntax))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("syntax %d, tag %s: count = %d, want %d", tt.syntax, tt.tag, got, tt.want)
+		}
+	}
+}
+
+// hugeFile writes a file of about size bytes of lines holding the tag "go" now
+// and then, returning its path and the count of the tag
+func hugeFile(t testing.TB, size int) (string, int) {
+	t.Helper()
+	var b strings.Builder
+	n := 0
+	for i := 0; b.Len() < size; i++ {
+		if i%7 == 0 {
+			b.WriteString(`{"lang": "go", "id": "` + strconv.Itoa(i) + "\"}\n")
+			n++
+		} else {
+			b.WriteString(`{"lang": "rust", "note": "` + strings.Repeat("x", i%50) + "\"}\n")
+		}
+	}
+	root := writeTree(t, map[string]string{"huge.json": b.String()})
+	return filepath.Join(root, "huge.json"), n
+}
+
+func TestCountTagParallel(t *testing.T) {
+	path, want := hugeFile(t, 1<<20)
+	for _, workers := range []int{0, 1, 2, 3, 8, 64} {
+		got, err := CountTagParallel(path, "go", workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%d workers: count = %d, want %d", workers, got, want)
+		}
+	}
+}
+
+func BenchmarkCountTagParallel(b *testing.B) {
+	path, _ := hugeFile(b, 32<<20)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := CountTagParallel(path, "go", workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCountTagIgnoreCaseFolding(t *testing.T) {
+	// the long s folds to s, though lowercasing leaves it as it is, and the
+	// Kelvin sign folds to k
+	input := "SUN Sun \u017fun sun \u212aiss kiss"
+	if strings.ToLower("\u017fun") == "sun" {
+		t.Fatal("lowercasing maps the long s, the test can't tell it from folding")
+	}
+
+	tests := []struct {
+		tag        string
+		ignoreCase bool
+		want       int
+	}{
+		{"sun", false, 1},
+		{"sun", true, 4},
+		{"kiss", false, 1},
+		{"kiss", true, 2},
+	}
+	for _, tt := range tests {
+		got, err := CountTag(strings.NewReader(input), tt.tag, WithWholeWord(true), WithIgnoreCase(tt.ignoreCase))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s, ignoring case %v: count = %d, want %d", tt.tag, tt.ignoreCase, got, tt.want)
+		}
+	}
+}
+
+func TestCountAttributeValues(t *testing.T) {
+	doc := `<html><body>
+<div class="todo">one</div>
+<P CLASS="todo">two
+<img class="todo" src="x.png">
+<br Class="todo">
+<span class="TODO">not this one</span>
+<span class="todo later">nor this</span>
+<a href="todo">nor this</a>
+</body></html>`
+
+	got, err := CountAttributeValues(strings.NewReader(doc), "class", "todo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 4 {
+		t.Errorf("count = %d, want 4", got)
+	}
+}
+
+func TestScanLines(t *testing.T) {
+	out := make(chan string)
+	errc := make(chan error, 1)
+	go func() { errc <- scanLines(context.Background(), strings.NewReader("a\r\nb\n\nc"), out) }()
+
+	var lines []string
+	for line := range out {
+		lines = append(lines, line)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "", "c"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+}
+
+func TestScanLinesCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan string)
+	errc := make(chan error, 1)
+	go func() { errc <- scanLines(ctx, strings.NewReader(strings.Repeat("line\n", 1000)), out) }()
+
+	<-out
+	cancel()
+
+	// out is closed once scanLines stops, whatever lines were sent before
+	for range out {
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scanLines didn't return after its context was canceled")
+	}
+}
+
+func TestCountTagOverlapping(t *testing.T) {
+	for _, tt := range []struct {
+		overlapping bool
+		want        int
+	}{{false, 2}, {true, 3}} {
+		n, err := CountTag(strings.NewReader("aaaa"), "aa", WithSyntax(SyntaxPlain), WithOverlapping(tt.overlapping))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.want {
+			t.Errorf("overlapping %v: count = %d, want %d", tt.overlapping, n, tt.want)
+		}
+	}
+}
+
+func TestCountTagBOM(t *testing.T) {
+	const content = "\ufefftodo: strip the BOM\ntodo again\n"
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"anchored", []Option{WithSyntax(SyntaxPlain), WithAnchorStart(true)}},
+		{"whole word", []Option{WithWholeWord(true), WithTrimCutset(":")}},
+		{"whole file", []Option{WithSyntax(SyntaxPlain), WithAnchorStart(true), WithWholeFile(true)}},
+		{"distinct lines", []Option{WithSyntax(SyntaxPlain), WithAnchorStart(true), WithDistinctLines(true)}},
+	}
+	for _, tt := range tests {
+		n, err := CountTag(strings.NewReader(content), "todo", tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("%s: count = %d, want 2", tt.name, n)
+		}
+	}
+
+	root := writeTree(t, map[string]string{"a.txt": content})
+	n, _, err := CountTagDetailed(root, "todo", tests[0].opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("file: count = %d, want 2", n)
+	}
+}
+
+func TestCountPatternsMultiline(t *testing.T) {
+	const content = "<item\n  id=\"1\"/>\n<item id=\"2\"/>\n"
+	patterns := map[string]*regexp.Regexp{
+		"item": regexp.MustCompile(`<item\s+id="\d+"/>`),
+		"id":   regexp.MustCompile(`id="\d+"`),
+	}
+
+	for _, tt := range []struct {
+		multiline bool
+		want      map[string]int
+	}{
+		{false, map[string]int{"item": 1, "id": 2}},
+		{true, map[string]int{"item": 2, "id": 2}},
+	} {
+		got, err := CountPatterns(strings.NewReader(content), patterns, WithMultiline(tt.multiline))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("multiline %v: counts = %v, want %v", tt.multiline, got, tt.want)
+		}
+	}
+}
+
+func TestCountTagSpecs(t *testing.T) {
+	const content = "Go go gopher\nc++ and libc++, GO\n"
+	specs := []TagSpec{
+		{Tag: "go", WholeWord: true, IgnoreCase: true},
+		{Tag: "c++"},
+		{Tag: "zig"},
+	}
+
+	got, err := CountTagSpecs(strings.NewReader(content), specs, WithSyntax(SyntaxPlain), WithTrimCutset(","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"go": 3, "c++": 2, "zig": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("counts = %v, want %v", got, want)
+	}
+
+	dup := []TagSpec{{Tag: "go", WholeWord: true}, {Tag: "go"}}
+	if _, err := CountTagSpecs(strings.NewReader(content), dup); err == nil {
+		t.Error("no error for a tag specified twice")
+	}
+}
+
+func TestGrepTagContext(t *testing.T) {
+	const content = `one
+two "go"
+three
+four
+five
+six "go"
+seven "go"
+eight
+nine`
+
+	got, err := GrepTagContext(strings.NewReader(content), "go", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MatchWithContext{
+		{Line: 2, Text: `two "go"`, Before: []string{"one"}, After: []string{"three"}},
+		{Line: 6, Text: `six "go"`, Before: []string{"five"}},
+		{Line: 7, Text: `seven "go"`, After: []string{"eight"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("matches = %+v, want %+v", got, want)
+	}
+}
+
+func TestWordFrequency(t *testing.T) {
+	const text = "The café's 2 cats chased the other café's cats, and the dog slept."
+
+	got, err := WordFrequency(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		"The": 1, "café": 2, "s": 2, "2": 1, "cats": 2, "chased": 1, "the": 2,
+		"other": 1, "and": 1, "dog": 1, "slept": 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("counts = %v, want %v", got, want)
+	}
+
+	got, err = WordFrequency(strings.NewReader(text), WithIgnoreCase(true), WithMinWordLength(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]int{"café": 2, "cats": 2, "chased": 1, "other": 1, "slept": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("folded counts of long words = %v, want %v", got, want)
+	}
+}
+
+func TestWordFrequencyStopwords(t *testing.T) {
+	const text = "The cat and THE dog and a bird"
+
+	got, err := WordFrequency(strings.NewReader(text), WithStopwords([]string{"the", "And"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"The": 1, "cat": 1, "and": 2, "THE": 1, "dog": 1, "a": 1, "bird": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("case sensitive counts = %v, want %v", got, want)
+	}
+
+	got, err = WordFrequency(strings.NewReader(text), WithStopwords(EnglishStopwords), WithIgnoreCase(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"cat": 1, "dog": 1, "bird": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("counts = %v, want %v", got, want)
+	}
+}
+
+func TestCountTagWholeFile(t *testing.T) {
+	content := `{"tags": ["go", "rust"]}` + "\n" + `["go"]` + "\r\n\n" + `"go" "go"`
+	for _, opts := range [][]Option{
+		nil,
+		{WithSyntax(SyntaxPlain)},
+		{WithIgnoreCase(true)},
+		{WithWholeWord(true), WithTrimCutset(`"[],`)},
+	} {
+		lines, err := CountTag(strings.NewReader(content), "go", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whole, err := CountTag(strings.NewReader(content), "go", append(opts, WithWholeFile(true))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines != 4 || whole != lines {
+			t.Errorf("%d options: whole file count %d, line count %d, want 4", len(opts), whole, lines)
+		}
+	}
+}
+
+func TestTagRange(t *testing.T) {
+	const content = "none\n\"go\" here\nnone\n\"go\" \"go\"\n\"go\"\nnone\n"
+
+	count, first, last, err := TagRange(strings.NewReader(content), "go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 || first != 2 || last != 5 {
+		t.Errorf("TagRange = %d, %d, %d, want 4 from line 2 to 5", count, first, last)
+	}
+
+	count, first, last, err = TagRange(strings.NewReader(content), "rust")
+	if err != nil || count != 0 || first != 0 || last != 0 {
+		t.Errorf("TagRange without matches = %d, %d, %d, %v, want zeros", count, first, last, err)
+	}
+}
+
+func TestCountJSONKey(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want int
+	}{
+		{`{"tags": ["tags"], "meta": {"tags": {"tags": 1}}, "list": [{"x": {"tags": []}}, [{"tags": null}]]}`, 5},
+		{`{"name": "tags", "values": ["tags", {"tag": "tags"}]}`, 0},
+		{`["tags", "tags"]`, 0},
+		{"{\"tags\": 1}\n{\"tags\": 2, \"tags\": 3}\n", 3},
+		{"\ufeff{\"tags\": 1}", 1},
+	}
+	for _, tt := range tests {
+		n, err := CountJSONKey(strings.NewReader(tt.doc), "tags")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.doc, err)
+		}
+		if n != tt.want {
+			t.Errorf("%s: count = %d, want %d", tt.doc, n, tt.want)
+		}
+	}
+
+	for _, doc := range []string{`{"tags": [1, 2}`, `{"tags": `} {
+		if _, err := CountJSONKey(strings.NewReader(doc), "tags"); err == nil {
+			t.Errorf("%s: no error for invalid JSON", doc)
+		}
+	}
+}
+
+func TestScanLinesCallback(t *testing.T) {
+	const content = "\"go\" first\nnone\n\"go\" third \"go\"\n\nfifth \"go\"\n"
+
+	type call struct {
+		n    int
+		line string
+	}
+	var calls []call
+	err := ScanLines(strings.NewReader(content), "go", func(n int, line string) {
+		calls = append(calls, call{n, line})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []call{{1, `"go" first`}, {3, `"go" third "go"`}, {5, `fifth "go"`}}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestNormalizeTag(t *testing.T) {
+	for _, tt := range []struct {
+		tag, want string
+		err       error
+	}{
+		{"go", "go", nil},
+		{"  go\t\n", "go", nil},
+		{"c++ ", "c++", nil},
+		{"", "", ErrEmptyTag},
+		{" \t\n", "", ErrEmptyTag},
+	} {
+		got, err := NormalizeTag(tt.tag)
+		if got != tt.want || err != tt.err {
+			t.Errorf("NormalizeTag(%q) = %q, %v, want %q, %v", tt.tag, got, err, tt.want, tt.err)
+		}
+	}
+
+	// the counters normalize tags too
+	if n, err := CountTag(strings.NewReader(`["go"]`), " go "); err != nil || n != 1 {
+		t.Errorf("CountTag with spaces around the tag = %d, %v, want 1", n, err)
+	}
+	if _, err := CountTag(strings.NewReader(`[""]`), "  "); !errors.Is(err, ErrEmptyTag) {
+		t.Errorf("CountTag of a blank tag: err = %v, want ErrEmptyTag", err)
+	}
+	root := writeTree(t, map[string]string{"a.json": `["go"]`})
+	if _, err := ParseFile(filepath.Join(root, "a.json"), []string{"go", ""}); !errors.Is(err, ErrEmptyTag) {
+		t.Errorf("ParseFile with an empty tag: err = %v, want ErrEmptyTag", err)
+	}
+}
+
+func TestNormalizedTagKeys(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json": `["todo", "Foo"]`,
+		"b.json": `["todo", "foo"]`,
+	})
+
+	out, err := Scan(root, []string{" todo", "todo "}, WithRelativePaths(true), WithNormalizeSlashes(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report scanReport
+	if err := json.Unmarshal(out, &report); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"todo": 2}; !reflect.DeepEqual(report.Totals, want) {
+		t.Errorf("Scan totals = %v, want %v", report.Totals, want)
+	}
+
+	if tag, n, err := MostCommonTag(root, []string{"todo "}); tag != "todo" || n != 2 || err != nil {
+		t.Errorf("MostCommonTag = %q, %d, %v, want \"todo\", 2", tag, n, err)
+	}
+
+	e, err := EstimateTagCounts(root, []string{" todo"}, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]float64{"todo": 2}; !reflect.DeepEqual(e.Counts, want) {
+		t.Errorf("EstimateTagCounts = %v, want %v", e.Counts, want)
+	}
+
+	// both spellings are counted under one key, once
+	out, err = Scan(root, []string{"Foo", "foo"}, WithIgnoreCase(true), WithNormalizeKeys(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = scanReport{}
+	if err := json.Unmarshal(out, &report); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"foo": 2}; !reflect.DeepEqual(report.Totals, want) {
+		t.Errorf("Scan totals folding case = %v, want %v", report.Totals, want)
+	}
+}
+
+func TestCountTagCollapseRuns(t *testing.T) {
+	tests := []struct {
+		content string
+		want    int
+	}{
+		{"foo foo bar foo", 2},
+		{"foo  \t foo foo", 1},
+		{"foo\nfoo", 2},
+		{"foo foo\r\nfoo bar\n\nfoo", 3},
+		{"bar", 0},
+	}
+	for _, tt := range tests {
+		for mode, opts := range map[string][]Option{
+			"plain":      {WithSyntax(SyntaxPlain)},
+			"whole word": {WithWholeWord(true)},
+		} {
+			opts = append(opts, WithCollapseRuns(true))
+			lines, err := CountTag(strings.NewReader(tt.content), "foo", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			whole, err := CountTag(strings.NewReader(tt.content), "foo", append(opts, WithWholeFile(true))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lines != tt.want || whole != tt.want {
+				t.Errorf("%q, %s: count %d by line, %d whole, want %d", tt.content, mode, lines, whole, tt.want)
+			}
+		}
+	}
+}
+
+func TestCountTagAnchors(t *testing.T) {
+	doc := "todo fix this\n  TODO: later\nnot a todo\ntodo\nfoo todo bar todo\n\"todo\" then \"todo\""
+	tests := []struct {
+		name string
+		opts []Option
+		want int
+	}{
+		{"start", []Option{WithWholeWord(true), WithAnchorStart(true)}, 2},
+		{"start ignoring case", []Option{WithWholeWord(true), WithAnchorStart(true), WithIgnoreCase(true), WithTrimCutset(":")}, 3},
+		{"end", []Option{WithWholeWord(true), WithAnchorEnd(true)}, 3},
+		{"both", []Option{WithWholeWord(true), WithAnchorStart(true), WithAnchorEnd(true)}, 1},
+		{"both, whole file", []Option{WithWholeWord(true), WithAnchorStart(true), WithAnchorEnd(true), WithWholeFile(true)}, 1},
+		{"start, whole file", []Option{WithWholeWord(true), WithAnchorStart(true), WithWholeFile(true)}, 2},
+		{"plain start", []Option{WithSyntax(SyntaxPlain), WithAnchorStart(true)}, 2},
+		{"plain both", []Option{WithSyntax(SyntaxPlain), WithAnchorStart(true), WithAnchorEnd(true)}, 1},
+		{"quoted start", []Option{WithAnchorStart(true)}, 1},
+		{"quoted end", []Option{WithAnchorEnd(true)}, 1},
+		{"not anchored", []Option{WithWholeWord(true)}, 5},
+	}
+	for _, tt := range tests {
+		got, err := CountTag(strings.NewReader(doc), "todo", tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: count = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		doc  string
+		opts []Option
+		want int
+	}{
+		{"todo foo bar", []Option{WithAnchorStart(true), WithAnchorEnd(true)}, 0},
+		{"todo a\ntodo b", []Option{WithAnchorStart(true), WithWholeFile(true)}, 2},
+		{"a todo\nb todo", []Option{WithAnchorEnd(true), WithWholeFile(true)}, 2},
+		{"a todo\r\nb todo\r\n", []Option{WithAnchorEnd(true), WithWholeFile(true)}, 2},
+		{"a todo\r\nb todo\r\n", []Option{WithAnchorEnd(true)}, 2},
+	} {
+		got, err := CountTag(strings.NewReader(tt.doc), "todo", append(tt.opts, WithWholeWord(true))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%q: count = %d, want %d", tt.doc, got, tt.want)
+		}
+	}
+
+	// the same with the regular expressions of plain tags
+	for _, wholeFile := range []bool{false, true} {
+		got, err := CountTag(strings.NewReader("x todo\r\ny todo\r\n"), "todo", WithSyntax(SyntaxPlain), WithAnchorEnd(true), WithWholeFile(wholeFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 2 {
+			t.Errorf("CRLF lines, whole file %v: count = %d, want 2", wholeFile, got)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package tagpipe
+
+import (
+	"errors"
+	"os"
+)
+
+// mmap isn't supported, so files are always read
+func mmap(f *os.File, size int64) ([]byte, error) { return nil, errors.ErrUnsupported }
+
+func munmap(data []byte) error { return nil }
@@ -0,0 +1,20 @@
+//go:build unix
+
+package tagpipe
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// mmap maps the first size bytes of f into memory, read only
+func mmap(f *os.File, size int64) ([]byte, error) {
+	if int64(int(size)) != size {
+		return nil, errors.New("file too large to map")
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmap unmaps memory mapped by mmap
+func munmap(data []byte) error { return syscall.Munmap(data) }
@@ -0,0 +1,474 @@
+package tagpipe
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Options controls how file trees are walked and how tags are matched
+type Options struct {
+	// FS is the file system trees are walked and files read from, in which case
+	// roots are paths in its syntax, e.g. "." for all of it. Nil means the
+	// operating system's, taking roots as they'd be passed to os.Open.
+	FS fs.FS
+	// TolerateDisappearing skips paths that are removed while the tree is
+	// being walked, rather than failing the whole walk
+	TolerateDisappearing bool
+	// ModifiedAfter skips files last modified before it, unless it's zero
+	ModifiedAfter time.Time
+	// HashPaths folds the path of each file into the digest of TreeDigest, so
+	// renaming a file changes it even if its contents don't
+	HashPaths bool
+	// MaxDepth limits how many levels of directories below root the walk
+	// descends into when DepthLimited is set, 0 only scanning the files in
+	// root itself
+	MaxDepth     int
+	DepthLimited bool
+	// MaxFiles stops the walk once it has found that many files to scan, in
+	// walk order, unless it's 0
+	MaxFiles int
+	// NameRegex skips files whose base name it doesn't match, e.g.
+	// ^CHANGELOG.* to only scan changelogs, unless it's nil
+	NameRegex *regexp.Regexp
+	// SampleRate scans only about that fraction of files, for quick
+	// approximate results on huge trees. Files are picked by a hash of their
+	// path relative to the root and SampleSeed, so the same seed picks the
+	// same files every time. Zero, or 1 and above, scans all files.
+	SampleRate float64
+	SampleSeed int64
+
+	// NormalizeSlashes uses forward slashes as separators in the paths results
+	// are keyed by, whatever the operating system, for portable reports
+	NormalizeSlashes bool
+	// RelativePaths keys results by paths relative to the root being walked,
+	// rather than including the root, so manifests are portable
+	RelativePaths bool
+
+	// PerFileTimeout bounds the time spent on each file. A file taking longer
+	// is skipped with an error wrapping ErrFileTimeout, reported by ScanTree
+	// in TreeReport.Skipped and logged by the others, and the scan goes on.
+	// DigestAllFiles doesn't support it.
+	PerFileTimeout time.Duration
+
+	// PruneOnError stops scanning a directory, and the directories below it,
+	// when a file in it fails to be opened or read, rather than failing the
+	// whole scan. Other errors, such as those of invalid tags, still fail it.
+	// The file's error wraps ErrSubtreePruned and is reported like those of
+	// PerFileTimeout. Files of the directory read by then keep their results.
+	// Directories that can't be listed are pruned too, with their errors
+	// logged. DigestAllFiles doesn't support it.
+	PruneOnError bool
+	pruned       *prunedDirs
+
+	// Timeout bounds how long ScanTree and ScanTreeResumable run, after which
+	// they return partial results. Zero means no timeout other than the
+	// context's.
+	Timeout time.Duration
+
+	// Store is given the tag counts of each file as ScanTree processes it
+	Store ResultStore
+
+	// Progress is called by MD5AllWithSizes, and so MD5All, after each file it
+	// hashes, with the bytes hashed so far and the total expected, which is 0
+	// unless TotalSizeEstimate is set
+	Progress func(done, total int64)
+	// TotalSizeEstimate walks the tree once more before hashing it, adding up
+	// the sizes of files, so Progress can be shown as a percentage
+	TotalSizeEstimate bool
+
+	// Syntax sets the delimiters around a tag when looking for occurrences of
+	// it, quotes by default. It has no effect in WholeWord mode.
+	Syntax TagSyntax
+	// Overlapping counts occurrences that overlap, e.g. 3 for "aa" in "aaaa"
+	// rather than 2, by resuming the search one character after the start of
+	// each match instead of after its end. This searches again per match, so
+	// it's slower on lines with many matches. It has no effect in WholeWord
+	// mode.
+	Overlapping bool
+	// AnchorStart only counts a tag at the start of a line, as for log level
+	// prefixes, and AnchorEnd only at its end. In WholeWord mode that's the
+	// first or last word of the line, ignoring surrounding whitespace. With
+	// both, the tag must be all the line holds. Overlapping has no effect with
+	// them.
+	AnchorStart bool
+	AnchorEnd   bool
+	// CollapseRuns counts a run of occurrences of a tag separated only by
+	// whitespace as one, e.g. 2 for foo in "foo foo bar foo" rather than 3.
+	// Runs end at line ends, with WholeFile too. It has no effect with
+	// Overlapping.
+	CollapseRuns bool
+	// WholeWord matches tags against whitespace separated words, instead of
+	// looking for quoted occurrences of the tag
+	WholeWord bool
+	// TrimCutset holds characters trimmed from both ends of each word before
+	// it's compared to the tag in WholeWord mode, e.g. ".,;\"" to match tags
+	// at the end of a sentence or inside quotes
+	TrimCutset string
+	// IgnoreCase matches tags regardless of case, using Unicode case folding
+	// rather than lowercasing, so e.g. the Kelvin sign matches "k"
+	IgnoreCase bool
+	// IncludeZeros lists every tag asked for in the counts of tags in each
+	// file, with 0 for those not found, rather than leaving them out, for
+	// comparing files
+	IncludeZeros bool
+	// NormalizeKeys reports the counts of tags under their lower case, when
+	// IgnoreCase is set, so tags differing only in case such as "Golang" and
+	// "golang" are counted once under "golang" rather than each counting the
+	// same occurrences.
+	NormalizeKeys bool
+	// ReadRateLimit caps the rate files are read at, in bytes per second
+	// across all the files read by a call, of all roots for those walking
+	// several. Zero means unlimited.
+	ReadRateLimit int64
+	limiter       *rate.Limiter
+	// DecompressAuto transparently decompresses gzip and bzip2 files, detected
+	// by their headers rather than their names, so tags are counted and
+	// digests taken over the content. Other files, including xz which the
+	// standard library can't read, are read as they are, as are files that
+	// fail to decompress before yielding any content.
+	DecompressAuto bool
+	// Mmap maps files of 1MB or more into memory and reads them from there,
+	// rather than copying them through read buffers, which is faster on
+	// large files. Where mapping isn't supported, or files aren't on the
+	// operating system's file system, they are read as usual.
+	Mmap bool
+	// MaxBytesPerFile reads only the first that many bytes of each file, of
+	// its content once decompressed, for scanning headers such as licenses
+	// quickly. Digests and sizes are then those of the prefix. Zero reads
+	// whole files.
+	MaxBytesPerFile int64
+	// SinglePass reads each file once, as a stream, to both hash it and count
+	// tags in it, rather than reading it into memory first. Tags are then
+	// matched line by line, so WholeFile and DistinctLines have no effect.
+	SinglePass bool
+
+	// CommentsOnly matches tags only in comments of Go source, // and /* */,
+	// rather than in code or string literals, as when counting TODOs. It
+	// applies when tags are matched line by line.
+	CommentsOnly bool
+	// DistinctLines counts the number of unique lines containing the tag,
+	// rather than the occurrences of the tag. Each distinct matching line
+	// costs 16 bytes of memory for as long as the input is read.
+	DistinctLines bool
+	// WholeFile reads the whole of each input and matches tags over it at
+	// once, rather than line by line, which is faster on moderately sized
+	// files with many short lines and finds tags spanning lines. Inputs are
+	// then held in memory. It has no effect with CommentsOnly or
+	// DistinctLines, which work on lines.
+	WholeFile bool
+	// MinWordLength leaves words shorter than it, in characters, out of
+	// WordFrequency
+	MinWordLength int
+	// Stopwords are left out of WordFrequency, compared regardless of case
+	// when IgnoreCase is set, e.g. EnglishStopwords
+	Stopwords []string
+	// Multiline matches patterns of CountPatterns that can match a newline, as
+	// in `<item\s+id=`, against the whole input at once rather than line by
+	// line, so matches spanning lines are found. The whole input is then held
+	// in memory, so it's only worth it on moderately sized files. Patterns
+	// that can't span lines are still matched line by line.
+	Multiline bool
+
+	// regexps holds the patterns compiled during the call the options are for,
+	// or by the Scanner making it
+	regexps *regexpCache
+	// bufs pools the read buffers of a Scanner's calls, each a *bufio.Reader
+	bufs *sync.Pool
+}
+
+// Option sets a field of Options, pass any number of them to the tree functions
+type Option func(*Options)
+
+// WithFS sets Options.FS
+func WithFS(fsys fs.FS) Option {
+	return func(o *Options) { o.FS = fsys }
+}
+
+// WithTolerateDisappearing sets Options.TolerateDisappearing
+func WithTolerateDisappearing(b bool) Option {
+	return func(o *Options) { o.TolerateDisappearing = b }
+}
+
+// WithModifiedAfter sets Options.ModifiedAfter
+func WithModifiedAfter(t time.Time) Option {
+	return func(o *Options) { o.ModifiedAfter = t }
+}
+
+// WithHashPaths sets Options.HashPaths
+func WithHashPaths(b bool) Option {
+	return func(o *Options) { o.HashPaths = b }
+}
+
+// WithMaxDepth sets Options.MaxDepth and Options.DepthLimited
+func WithMaxDepth(n int) Option {
+	return func(o *Options) { o.MaxDepth, o.DepthLimited = n, true }
+}
+
+// WithMaxFiles sets Options.MaxFiles
+func WithMaxFiles(n int) Option {
+	return func(o *Options) { o.MaxFiles = n }
+}
+
+// WithNameRegex sets Options.NameRegex
+func WithNameRegex(re *regexp.Regexp) Option {
+	return func(o *Options) { o.NameRegex = re }
+}
+
+// WithSampleRate sets Options.SampleRate and Options.SampleSeed
+func WithSampleRate(fraction float64, seed int64) Option {
+	return func(o *Options) { o.SampleRate, o.SampleSeed = fraction, seed }
+}
+
+// WithNormalizeSlashes sets Options.NormalizeSlashes
+func WithNormalizeSlashes(b bool) Option {
+	return func(o *Options) { o.NormalizeSlashes = b }
+}
+
+// WithRelativePaths sets Options.RelativePaths
+func WithRelativePaths(b bool) Option {
+	return func(o *Options) { o.RelativePaths = b }
+}
+
+// WithPerFileTimeout sets Options.PerFileTimeout
+func WithPerFileTimeout(d time.Duration) Option {
+	return func(o *Options) { o.PerFileTimeout = d }
+}
+
+// WithSubtreeErrorPolicy sets Options.PruneOnError
+func WithSubtreeErrorPolicy(prune bool) Option {
+	return func(o *Options) {
+		o.PruneOnError = prune
+		o.pruned = nil
+		if prune {
+			o.pruned = &prunedDirs{}
+		}
+	}
+}
+
+// WithTimeout sets Options.Timeout
+func WithTimeout(d time.Duration) Option {
+	return func(o *Options) { o.Timeout = d }
+}
+
+// WithResultStore sets Options.Store
+func WithResultStore(s ResultStore) Option {
+	return func(o *Options) { o.Store = s }
+}
+
+// WithProgress sets Options.Progress
+func WithProgress(fn func(done, total int64)) Option {
+	return func(o *Options) { o.Progress = fn }
+}
+
+// WithTotalSizeEstimate sets Options.TotalSizeEstimate
+func WithTotalSizeEstimate(b bool) Option {
+	return func(o *Options) { o.TotalSizeEstimate = b }
+}
+
+// WithSyntax sets Options.Syntax
+func WithSyntax(syntax TagSyntax) Option {
+	return func(o *Options) { o.Syntax = syntax }
+}
+
+// WithReadRateLimit sets Options.ReadRateLimit
+func WithReadRateLimit(bytesPerSec int64) Option {
+	return func(o *Options) {
+		o.ReadRateLimit = bytesPerSec
+		o.limiter = nil
+		if bytesPerSec > 0 {
+			o.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), rateBurst(bytesPerSec))
+		}
+	}
+}
+
+// WithDecompressAuto sets Options.DecompressAuto
+func WithDecompressAuto(b bool) Option {
+	return func(o *Options) { o.DecompressAuto = b }
+}
+
+// WithMmap sets Options.Mmap
+func WithMmap(b bool) Option {
+	return func(o *Options) { o.Mmap = b }
+}
+
+// WithMaxBytesPerFile sets Options.MaxBytesPerFile
+func WithMaxBytesPerFile(n int64) Option {
+	return func(o *Options) { o.MaxBytesPerFile = n }
+}
+
+// WithSinglePass sets Options.SinglePass
+func WithSinglePass(b bool) Option {
+	return func(o *Options) { o.SinglePass = b }
+}
+
+// WithOverlapping sets Options.Overlapping
+func WithOverlapping(b bool) Option {
+	return func(o *Options) { o.Overlapping = b }
+}
+
+// WithAnchorStart sets Options.AnchorStart
+func WithAnchorStart(b bool) Option {
+	return func(o *Options) { o.AnchorStart = b }
+}
+
+// WithAnchorEnd sets Options.AnchorEnd
+func WithAnchorEnd(b bool) Option {
+	return func(o *Options) { o.AnchorEnd = b }
+}
+
+// WithCollapseRuns sets Options.CollapseRuns
+func WithCollapseRuns(b bool) Option {
+	return func(o *Options) { o.CollapseRuns = b }
+}
+
+// WithWholeWord sets Options.WholeWord
+func WithWholeWord(b bool) Option {
+	return func(o *Options) { o.WholeWord = b }
+}
+
+// WithTrimCutset sets Options.TrimCutset
+func WithTrimCutset(cutset string) Option {
+	return func(o *Options) { o.TrimCutset = cutset }
+}
+
+// WithIgnoreCase sets Options.IgnoreCase
+func WithIgnoreCase(b bool) Option {
+	return func(o *Options) { o.IgnoreCase = b }
+}
+
+// WithIncludeZeros sets Options.IncludeZeros
+func WithIncludeZeros(b bool) Option {
+	return func(o *Options) { o.IncludeZeros = b }
+}
+
+// WithNormalizeKeys sets Options.NormalizeKeys
+func WithNormalizeKeys(b bool) Option {
+	return func(o *Options) { o.NormalizeKeys = b }
+}
+
+// WithCommentsOnly sets Options.CommentsOnly
+func WithCommentsOnly(b bool) Option {
+	return func(o *Options) { o.CommentsOnly = b }
+}
+
+// WithWholeFile sets Options.WholeFile
+func WithWholeFile(b bool) Option {
+	return func(o *Options) { o.WholeFile = b }
+}
+
+// WithMinWordLength sets Options.MinWordLength
+func WithMinWordLength(n int) Option {
+	return func(o *Options) { o.MinWordLength = n }
+}
+
+// WithStopwords sets Options.Stopwords
+func WithStopwords(words []string) Option {
+	return func(o *Options) { o.Stopwords = words }
+}
+
+// WithMultiline sets Options.Multiline
+func WithMultiline(b bool) Option {
+	return func(o *Options) { o.Multiline = b }
+}
+
+// WithDistinctLines sets Options.DistinctLines
+func WithDistinctLines(b bool) Option {
+	return func(o *Options) { o.DistinctLines = b }
+}
+
+// sampled reports whether the file at path, in the tree rooted at root, is in the
+// sample picked by SampleRate
+func (o *Options) sampled(root, path string) bool {
+	if o.SampleRate <= 0 || o.SampleRate >= 1 {
+		return true
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		rel = path
+	}
+	h := md5.New()
+	binary.Write(h, binary.LittleEndian, o.SampleSeed)
+	h.Write([]byte(filepath.ToSlash(rel)))
+	return float64(binary.LittleEndian.Uint64(h.Sum(nil))) < o.SampleRate*math.MaxUint64
+}
+
+// tooDeep reports whether the directory at path is deeper below root than
+// MaxDepth allows
+func (o *Options) tooDeep(root, path string) bool {
+	if !o.DepthLimited {
+		return false
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	return strings.Count(filepath.ToSlash(rel), "/")+1 > o.MaxDepth
+}
+
+// fsys returns the file system to walk and read from
+func (o *Options) fsys() fs.FS {
+	if o.FS == nil {
+		return osFS{}
+	}
+	return o.FS
+}
+
+// key returns the key of the results for the file at path, found under root
+func (o *Options) key(root, path string) string {
+	if o.RelativePaths {
+		if rel, err := filepath.Rel(root, path); err == nil {
+			path = rel
+		}
+	}
+	if o.NormalizeSlashes {
+		path = filepath.ToSlash(path)
+	}
+	return path
+}
+
+// newOptions returns the default Options with opts applied in order
+func newOptions(opts []Option) *Options {
+	o := &Options{regexps: &regexpCache{}}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// readBuffer returns a buffered reader of r, taken from the pool of o if it has
+// one, along with the func to call once done with it
+func (o *Options) readBuffer(r io.Reader) (*bufio.Reader, func()) {
+	if o.bufs == nil {
+		return bufio.NewReader(r), func() {}
+	}
+	br := o.bufs.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br, func() {
+		br.Reset(nil)
+		o.bufs.Put(br)
+	}
+}
+
+// sharedOptions returns opts set up for one call walking several trees, each
+// applying them anew, so the trees share the state meant to span the call,
+// such as the rate limiter of ReadRateLimit
+func sharedOptions(opts []Option) []Option {
+	l := newOptions(opts).limiter
+	if l == nil {
+		return opts
+	}
+	return append(opts[:len(opts):len(opts)], func(o *Options) { o.limiter = l })
+}
@@ -0,0 +1,155 @@
+package tagpipe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// PathCount is the tag count of a single file, as written by the JSON writers
+type PathCount struct {
+	Path  string `json:"path"`
+	Count int    `json:"count"`
+}
+
+// StreamTagCountsJSON walks the file tree rooted at root and writes a JSON array
+// of per-file counts of tag, matched according to opts, to w. Elements are
+// written as soon as each file is processed, so memory use stays flat
+// regardless of the size of the tree.
+func StreamTagCountsJSON(ctx context.Context, root, tag string, w io.Writer, opts ...Option) error {
+	tag, err := NormalizeTag(tag)
+	if err != nil {
+		return err
+	}
+
+	// cancel the walk if we return before it's finished
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	o := newOptions(opts)
+	paths, errc, _ := walkFiles(ctx.Done(), root, o)
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	first := true
+	for path := range paths {
+		n, err := countTagInFile(path, tag, o)
+		if err != nil {
+			return err
+		}
+
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		if err := enc.Encode(PathCount{Path: o.key(root, path), Count: n}); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]")
+	return err
+}
+
+// WriteResultsJSONL writes results, counts by path, to w as JSON Lines: one
+// object per line, sorted by path so the output is deterministic
+func WriteResultsJSONL(w io.Writer, results map[string]int) error {
+	paths := make([]string, 0, len(results))
+	for path := range results {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// Encode terminates each value with a newline
+	enc := json.NewEncoder(w)
+	for _, path := range paths {
+		if err := enc.Encode(PathCount{Path: path, Count: results[path]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTagCountsMarkdown writes counts to w as a GitHub flavored Markdown table,
+// most common tags first, for pasting in docs and pull requests. Pipes in tags
+// are escaped so they don't split cells. counts is left as is.
+func WriteTagCountsMarkdown(w io.Writer, counts TList) error {
+	tl := append(TList(nil), counts...)
+	sort.Slice(tl, func(i, j int) bool { return sortsBefore(tl[i], tl[j]) })
+
+	var b strings.Builder
+	b.WriteString("| Tag | Count |\n| --- | ---: |\n")
+	for _, t := range tl {
+		fmt.Fprintf(&b, "| %s | %d |\n", strings.ReplaceAll(t.Tag, "|", `\|`), t.Count)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// scanReport is the JSON document returned by Scan
+type scanReport struct {
+	Totals map[string]int            `json:"totals"`
+	Files  map[string]map[string]int `json:"files"`
+}
+
+// Scan walks the file tree rooted at root, counts tags in every file and returns
+// a JSON report of the total count of each tag along with the counts in each
+// file. Every tag appears in the totals, while files only list the tags found
+// in them.
+func Scan(root string, tags []string, opts ...Option) ([]byte, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	o := newOptions(opts)
+	tags, err := normalizeTags(tags, o)
+	if err != nil {
+		return nil, err
+	}
+	c, errc := scanFiles(done, root, o, func(path string) Result {
+		return parsePath(path, tags, o)
+	})
+
+	report := scanReport{
+		Totals: make(map[string]int, len(tags)),
+		Files:  make(map[string]map[string]int),
+	}
+	for _, tag := range tags {
+		report.Totals[tag] = 0
+	}
+	for r := range c {
+		if r.E != nil {
+			if skipped(r) {
+				continue
+			}
+			return nil, r.E
+		}
+		report.Files[r.Path] = r.T
+		for t, n := range r.T {
+			report.Totals[t] += n
+		}
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return json.Marshal(report)
+}
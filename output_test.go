@@ -0,0 +1,152 @@
+package tagpipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStreamTagCountsJSON(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json":     `{"tags": ["go", "go"]}`,
+		"b.json":     `{"tags": ["rust"]}`,
+		"sub/c.json": `["go"]`,
+	})
+
+	var buf bytes.Buffer
+	err := StreamTagCountsJSON(context.Background(), root, "go", &buf, WithRelativePaths(true), WithNormalizeSlashes(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsValidJSON(buf.String()) {
+		t.Fatalf("output isn't valid JSON: %s", buf.String())
+	}
+
+	var counts []PathCount
+	if err := json.Unmarshal(buf.Bytes(), &counts); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int)
+	for _, pc := range counts {
+		got[pc.Path] = pc.Count
+	}
+	want := map[string]int{"a.json": 2, "b.json": 0, "sub/c.json": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("counts = %v, want %v", got, want)
+	}
+}
+
+func TestStreamTagCountsJSONEmptyTree(t *testing.T) {
+	var buf bytes.Buffer
+	if err := StreamTagCountsJSON(context.Background(), t.TempDir(), "go", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "[]" {
+		t.Errorf("output = %q, want []", got)
+	}
+}
+
+func TestStreamTagCountsJSONMatchingOptions(t *testing.T) {
+	root := writeTree(t, map[string]string{"a.txt": "TODO fix\ntodo: later"})
+
+	var buf bytes.Buffer
+	err := StreamTagCountsJSON(context.Background(), root, "todo", &buf,
+		WithRelativePaths(true), WithWholeWord(true), WithTrimCutset(":"), WithIgnoreCase(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counts []PathCount
+	if err := json.Unmarshal(buf.Bytes(), &counts); err != nil {
+		t.Fatal(err)
+	}
+	if want := []PathCount{{Path: "a.txt", Count: 2}}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts = %v, want %v", counts, want)
+	}
+}
+
+func TestScan(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json":     `["go", "go", "rust"]`,
+		"sub/b.json": `{"go": true}`,
+	})
+
+	data, err := Scan(root, []string{"go", "rust", "zig"}, WithRelativePaths(true), WithNormalizeSlashes(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsValidJSON(string(data)) {
+		t.Fatalf("report isn't valid JSON: %s", data)
+	}
+
+	var report struct {
+		Totals map[string]int
+		Files  map[string]map[string]int
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"go": 3, "rust": 1, "zig": 0}; !reflect.DeepEqual(report.Totals, want) {
+		t.Errorf("totals = %v, want %v", report.Totals, want)
+	}
+	want := map[string]map[string]int{"a.json": {"go": 2, "rust": 1}, "sub/b.json": {"go": 1}}
+	if !reflect.DeepEqual(report.Files, want) {
+		t.Errorf("files = %v, want %v", report.Files, want)
+	}
+}
+
+func TestWriteResultsJSONL(t *testing.T) {
+	results := map[string]int{"b.json": 0, "a.json": 2, "sub/c.json": 1, "quote\".json": 3}
+
+	var buf bytes.Buffer
+	if err := WriteResultsJSONL(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	got := make(map[string]int)
+	var paths []string
+	for i, line := range lines {
+		var pc PathCount
+		if err := json.Unmarshal([]byte(line), &pc); err != nil {
+			t.Fatalf("line %d: %v: %s", i+1, err, line)
+		}
+		got[pc.Path] = pc.Count
+		paths = append(paths, pc.Path)
+	}
+	if !reflect.DeepEqual(got, results) {
+		t.Errorf("results = %v, want %v", got, results)
+	}
+	if want := []string{"a.json", "b.json", "quote\".json", "sub/c.json"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths in order %q, want %q", paths, want)
+	}
+}
+
+func TestWriteTagCountsMarkdown(t *testing.T) {
+	counts := TList{{"rust", 2}, {"c|c++", 2}, {"go", 5}}
+
+	var buf bytes.Buffer
+	if err := WriteTagCountsMarkdown(&buf, counts); err != nil {
+		t.Fatal(err)
+	}
+	want := "| Tag | Count |\n" +
+		"| --- | ---: |\n" +
+		"| go | 5 |\n" +
+		"| c\\|c++ | 2 |\n" +
+		"| rust | 2 |\n"
+	if got := buf.String(); got != want {
+		t.Errorf("table =\n%s\nwant\n%s", got, want)
+	}
+
+	// every row has as many cells as the header, counting unescaped pipes
+	for i, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if cells := strings.Count(strings.ReplaceAll(line, `\|`, ""), "|"); cells != 3 {
+			t.Errorf("row %d has %d pipes, want 3: %s", i, cells, line)
+		}
+	}
+	if !reflect.DeepEqual(counts, TList{{"rust", 2}, {"c|c++", 2}, {"go", 5}}) {
+		t.Errorf("counts changed to %v", counts)
+	}
+}
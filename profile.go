@@ -0,0 +1,56 @@
+package tagpipe
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profile accumulates the time spent in named phases, a structured TimeTrack.
+// It's safe for concurrent use, so a phase can be tracked by many goroutines.
+type Profile struct {
+	mu     sync.Mutex
+	phases map[string]time.Duration
+}
+
+// Track starts timing phase and returns the func to call when the phase ends, as
+// in defer p.Track("walk")(). Tracking a phase again adds to its total.
+func (p *Profile) Track(phase string) func() {
+	start := time.Now()
+	return func() {
+		elapsed := time.Since(start)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.phases == nil {
+			p.phases = make(map[string]time.Duration)
+		}
+		p.phases[phase] += elapsed
+	}
+}
+
+// Summary returns a line per phase in the format of TimeTrack, longest first
+func (p *Profile) Summary() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, 0, len(p.phases))
+	for name := range p.phases {
+		names = append(names, name)
+	}
+	phases := p.phases
+	sort.Slice(names, func(i, j int) bool {
+		if phases[names[i]] != phases[names[j]] {
+			return phases[names[i]] > phases[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s took %s\n", name, phases[name])
+	}
+	return b.String()
+}
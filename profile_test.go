@@ -0,0 +1,24 @@
+package tagpipe
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProfileSummary(t *testing.T) {
+	var p Profile
+	done := p.Track("walk")
+	time.Sleep(20 * time.Millisecond)
+	done()
+	p.Track("hash")()
+
+	lines := strings.Split(strings.TrimSuffix(p.Summary(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("summary has %d lines, want 2: %q", len(lines), lines)
+	}
+	// longest first
+	if !strings.HasPrefix(lines[0], "walk took ") || !strings.HasPrefix(lines[1], "hash took ") {
+		t.Errorf("summary = %q, want walk then hash", lines)
+	}
+}
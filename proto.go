@@ -0,0 +1,32 @@
+package tagpipe
+
+import (
+	"google.golang.org/protobuf/proto"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative tagpipe.proto
+
+// MarshalResultsProto encodes counts as a TagCounts protobuf message, defined in
+// tagpipe.proto, for returning them over gRPC
+func MarshalResultsProto(counts TList) ([]byte, error) {
+	m := &TagCounts{Counts: make([]*TagCount, len(counts))}
+	for i, t := range counts {
+		m.Counts[i] = &TagCount{Tag: t.Tag, Count: int64(t.Count)}
+	}
+	return proto.Marshal(m)
+}
+
+// UnmarshalResultsProto decodes a TagCounts protobuf message, as encoded by
+// MarshalResultsProto. Unknown fields are skipped.
+func UnmarshalResultsProto(b []byte) (TList, error) {
+	var m TagCounts
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	counts := make(TList, len(m.Counts))
+	for i, t := range m.Counts {
+		counts[i] = T{Tag: t.Tag, Count: int(t.Count)}
+	}
+	return counts, nil
+}
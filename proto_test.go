@@ -0,0 +1,53 @@
+package tagpipe
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// tagCountsProto is tagCounts encoded as a TagCounts message from tagpipe.proto by
+// buf, with
+//
+//	buf convert tagpipe.proto --type tagpipe.TagCounts --from counts.json --to counts.binpb
+var (
+	tagCountsProto, _ = hex.DecodeString("0a060a02676f10030a130a0668c3a96c6c6f10ffffffffffffffffff010a000a021007")
+	tagCounts         = TList{{"go", 3}, {"héllo", -1}, {"", 0}, {"", 7}}
+)
+
+func TestMarshalResultsProto(t *testing.T) {
+	b, err := MarshalResultsProto(tagCounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b, tagCountsProto) {
+		t.Errorf("encoded %x, want %x", b, tagCountsProto)
+	}
+
+	got, err := UnmarshalResultsProto(tagCountsProto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, tagCounts) {
+		t.Errorf("decoded %v, want %v", got, tagCounts)
+	}
+
+	if _, err := MarshalResultsProto(TList{{"\xff", 1}}); err == nil {
+		t.Error("tag that isn't UTF-8 encoded without an error")
+	}
+	if _, err := UnmarshalResultsProto(tagCountsProto[:len(tagCountsProto)-1]); err == nil {
+		t.Error("truncated message decoded without an error")
+	}
+}
+
+func TestUnmarshalResultsProtoUnknownFields(t *testing.T) {
+	// TagCounts with a fixed64 field 2, and a TagCount with a string field 3
+	b, _ := hex.DecodeString("110102030405060708" + "0a060a02676f1a00" + "0a0410051801")
+	got, err := UnmarshalResultsProto(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (TList{{"go", 0}, {"", 5}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,290 @@
+package tagpipe
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// skippedModes are the file types never scanned: directories, symbolic links,
+// named pipes, sockets, block and character devices, and irregular files. Only
+// regular files are read, as reading the others may block forever or never end.
+const skippedModes = fs.ModeDir | fs.ModeSymlink | fs.ModeNamedPipe | fs.ModeSocket |
+	fs.ModeDevice | fs.ModeCharDevice | fs.ModeIrregular
+
+// openFile opens the file at path for reading, with the reader set up as o asks.
+// All reads of scanned files go through it. Files that aren't regular by the
+// time they're opened, despite what the walk saw, are refused. The file holds
+// a slot of SetMaxConcurrency until it's closed.
+func openFile(path string, o *Options) (io.ReadCloser, error) {
+	release := acquireFile()
+	file, err := o.fsys().Open(path)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	f := &releasingFile{File: file, release: release}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Mode()&skippedModes != 0 {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: path, Err: errors.New("not a regular file")}
+	}
+
+	var r io.Reader = f
+	var c io.Closer = f
+	if o.Mmap && info.Size() >= mmapMinSize {
+		// fall back to reading the file where it can't be mapped
+		if osf, ok := file.(*os.File); ok {
+			if data, err := mmap(osf, info.Size()); err == nil {
+				r, c = bytes.NewReader(data), mappedFile{data, f}
+			}
+		}
+	}
+	if o.limiter != nil {
+		r = &rateLimitedReader{r: r, l: o.limiter}
+	}
+	if o.DecompressAuto {
+		if r, err = decompress(r); err != nil {
+			c.Close()
+			return nil, &fs.PathError{Op: "decompress", Path: path, Err: err}
+		}
+	}
+	if o.MaxBytesPerFile > 0 {
+		r = io.LimitReader(r, o.MaxBytesPerFile)
+	}
+	return readCloser{pathReader{r, path}, c}, nil
+}
+
+// mmapMinSize is the size below which files are read rather than mapped, as
+// mapping costs more than copying small files
+const mmapMinSize = 1 << 20
+
+// mappedFile unmaps the mapped contents of a file when it's closed
+type mappedFile struct {
+	data []byte
+	f    io.Closer
+}
+
+func (m mappedFile) Close() error {
+	err := munmap(m.data)
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Headers starting compressed streams: the gzip magic followed by its only
+// compression method, deflate, and the bzip2 magic followed by a block size
+// from 1 to 9 and the magic of either a block or the end of the stream
+var (
+	gzipHeader       = []byte{0x1f, 0x8b, 0x08}
+	bzip2Magic       = []byte("BZh")
+	bzip2BlockMagic  = []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+	bzip2StreamMagic = []byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90}
+)
+
+// decompress returns a reader of the decompressed content of r if it starts with
+// a gzip or bzip2 header, and of r as it is otherwise, or if it fails to
+// decompress before yielding any content
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(bzip2Magic) + 1 + len(bzip2BlockMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	raw := new(bytes.Buffer)
+	tee := io.TeeReader(br, raw)
+	switch {
+	case bytes.HasPrefix(head, gzipHeader):
+		zr, err := gzip.NewReader(tee)
+		if err != nil {
+			return io.MultiReader(raw, br), nil
+		}
+		return &rawFallback{r: zr, raw: raw, src: br}, nil
+	case isBzip2(head):
+		return &rawFallback{r: bzip2.NewReader(tee), raw: raw, src: br}, nil
+	}
+	return br, nil
+}
+
+// isBzip2 reports whether head is the start of a bzip2 stream
+func isBzip2(head []byte) bool {
+	if !bytes.HasPrefix(head, bzip2Magic) || len(head) < len(bzip2Magic)+1+len(bzip2BlockMagic) {
+		return false
+	}
+	level, magic := head[len(bzip2Magic)], head[len(bzip2Magic)+1:]
+	return '1' <= level && level <= '9' &&
+		(bytes.Equal(magic, bzip2BlockMagic) || bytes.Equal(magic, bzip2StreamMagic))
+}
+
+// rawFallback reads the decompressed content of a stream, unless it fails to
+// decompress before yielding any, in which case it reads the stream as it is,
+// as for a text file that happens to start like a compressed one. Until then,
+// raw holds what the decompressor read of src, at most a compressed block.
+type rawFallback struct {
+	r   io.Reader
+	raw *bytes.Buffer
+	src io.Reader
+}
+
+func (f *rawFallback) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if f.raw == nil || (n == 0 && err == nil) {
+		return n, err
+	}
+	if n == 0 && err != io.EOF {
+		f.r = io.MultiReader(f.raw, f.src)
+		f.raw = nil
+		return f.r.Read(p)
+	}
+	f.raw = nil
+	return n, err
+}
+
+// releasingFile frees its SetMaxConcurrency slot once closed
+type releasingFile struct {
+	fs.File
+	release func()
+	once    sync.Once
+}
+
+func (f *releasingFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(f.release)
+	return err
+}
+
+// prunedDirs is the set of directories not to scan further, safe for use by the
+// walk and the digesters at once. A nil set holds nothing.
+type prunedDirs struct {
+	mu   sync.RWMutex
+	dirs map[string]bool
+}
+
+func (p *prunedDirs) add(dir string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dirs == nil {
+		p.dirs = make(map[string]bool)
+	}
+	p.dirs[dir] = true
+}
+
+// has reports whether path is a pruned directory or below one
+func (p *prunedDirs) has(path string) bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for {
+		if p.dirs[path] {
+			return true
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		path = parent
+	}
+}
+
+// osFS is the operating system's file system. Unlike os.DirFS it takes paths as
+// they are, relative or absolute, so results keep the paths callers passed in.
+type osFS struct{}
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+// Stat doesn't follow a symbolic link at root, like filepath.Walk
+func (osFS) Stat(name string) (fs.FileInfo, error) { return os.Lstat(name) }
+
+// readFile reads the whole file at path through openFile
+func readFile(path string, o *Options) ([]byte, error) {
+	f, err := openFile(path, o)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// readCloser reads from a wrapped reader but closes the underlying file
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// pathReader reports the errors of reads from r, other than io.EOF, as
+// *fs.PathErrors of the file at path, so they tell from the errors of what's
+// done with the content
+type pathReader struct {
+	r    io.Reader
+	path string
+}
+
+func (pr pathReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if err != nil && err != io.EOF && !errors.As(err, new(*fs.PathError)) {
+		err = &fs.PathError{Op: "read", Path: pr.path, Err: err}
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// rateBurst returns the burst of a limiter allowing bytesPerSec, which is also the
+// most a single read may return. It's kept small so throughput stays smooth.
+func rateBurst(bytesPerSec int64) int {
+	if bytesPerSec > 32*1024 {
+		return 32 * 1024
+	}
+	return int(bytesPerSec)
+}
+
+// rateLimitedReader throttles reads from r to the rate allowed by l, which may be
+// shared by readers of many files to cap their aggregate throughput
+type rateLimitedReader struct {
+	r io.Reader
+	l *rate.Limiter
+}
+
+func (lr *rateLimitedReader) Read(p []byte) (int, error) {
+	if b := lr.l.Burst(); len(p) > b {
+		p = p[:b]
+	}
+
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.l.WaitN(context.Background(), n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,222 @@
+package tagpipe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// minReadTime returns the least time reading n bytes takes under a limit of
+// bytesPerSec, whose first burst is read at once
+func minReadTime(n, bytesPerSec int64) time.Duration {
+	return time.Duration(float64(n-int64(rateBurst(bytesPerSec))) / float64(bytesPerSec) * float64(time.Second))
+}
+
+func TestReadRateLimit(t *testing.T) {
+	const size, limit = 100 << 10, 200 << 10
+	root := writeTree(t, map[string]string{"a.txt": strings.Repeat("x", size)})
+
+	start := time.Now()
+	if _, err := MD5All(root, WithReadRateLimit(limit)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed, want := time.Since(start), minReadTime(size, limit); elapsed < want {
+		t.Errorf("read %d bytes in %v, want at least %v", size, elapsed, want)
+	}
+}
+
+func TestReadRateLimitSharedByRoots(t *testing.T) {
+	const size, limit = 100 << 10, 200 << 10
+	roots := []string{
+		writeTree(t, map[string]string{"a.txt": strings.Repeat("a", size)}),
+		writeTree(t, map[string]string{"b.txt": strings.Repeat("b", size)}),
+	}
+
+	start := time.Now()
+	if _, err := MD5AllRoots(roots, WithReadRateLimit(limit)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed, want := time.Since(start), minReadTime(2*size, limit); elapsed < want {
+		t.Errorf("read %d bytes from 2 roots in %v, want at least %v", 2*size, elapsed, want)
+	}
+}
+
+// bzip2Tags is `["go", "go", "rust"]` and a newline, compressed by bzip2 -9, as
+// the standard library only decompresses bzip2
+const bzip2Tags = "\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\xe8\x97\xe7\xdb\x00\x00" +
+	"\x05\xd3\x80\x00\x10\x50\x04\x00\x0a\x00\x80\x9e\x00\x20\x00\x21" +
+	"\x2a\x69\xa6\x9e\x93\x6a\x10\x34\x0d\x0a\xe0\x8c\x5d\x10\xa3\x56" +
+	"\x43\x6f\xe2\xee\x48\xa7\x0a\x12\x1d\x12\xfc\xfb\x60"
+
+func TestDecompressAuto(t *testing.T) {
+	const raw = "[\"go\", \"go\", \"rust\"]\n"
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	// repeated, so gzip compresses rather than stores it
+	zw.Write([]byte(strings.Repeat(raw, 100)))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"a.json.gz":  {Data: gz.Bytes()},
+		"b.json.bz2": {Data: []byte(bzip2Tags)},
+		"c.json":     {Data: []byte(raw)},
+	}
+
+	for _, auto := range []bool{false, true} {
+		opts := []Option{WithFS(fsys), WithDecompressAuto(auto)}
+		_, perFile, err := CountTagDetailed(".", "go", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]int{"a.json.gz": 0, "b.json.bz2": 0, "c.json": 2}
+		if auto {
+			want = map[string]int{"a.json.gz": 200, "b.json.bz2": 2, "c.json": 2}
+		}
+		if !reflect.DeepEqual(perFile, want) {
+			t.Errorf("auto %v: counts = %v, want %v", auto, perFile, want)
+		}
+
+		sums, err := MD5All(".", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := sums["b.json.bz2"]; auto != (sum == md5.Sum([]byte(raw))) {
+			t.Errorf("auto %v: sum of the bzip2 file %x, want the sum of the decompressed contents only when auto", auto, sum)
+		}
+	}
+}
+
+func TestDecompressAutoFallsBackToRaw(t *testing.T) {
+	fsys := fstest.MapFS{
+		// starts with the bzip2 magic, but no block size or block magic
+		"a.json": {Data: []byte("BZh is how [\"go\"] spells it\n")},
+		// a gzip header followed by a body that isn't deflate
+		"b.json": {Data: append([]byte{0x1f, 0x8b, 0x08, 0, 0, 0, 0, 0, 0, 0xff}, " [\"go\"] \xff\xff\xff\n"...)},
+		// a full bzip2 header followed by a corrupt block
+		"c.json": {Data: []byte(bzip2Tags[:10] + " [\"go\"] \n")},
+	}
+
+	_, perFile, err := CountTagDetailed(".", "go", WithFS(fsys), WithDecompressAuto(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"a.json": 1, "b.json": 1, "c.json": 1}; !reflect.DeepEqual(perFile, want) {
+		t.Errorf("counts = %v, want %v", perFile, want)
+	}
+
+	sums, err := MD5All(".", WithFS(fsys), WithDecompressAuto(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, f := range fsys {
+		if want := md5.Sum(f.Data); sums[path] != want {
+			t.Errorf("sum of %s = %x, want the sum of its raw content %x", path, sums[path], want)
+		}
+	}
+}
+
+func TestMaxBytesPerFile(t *testing.T) {
+	const raw = "[\"go\", \"go\", \"rust\"]\n"
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(strings.Repeat(raw, 100)))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"a.json":    {Data: []byte(raw)},
+		"b.json.gz": {Data: gz.Bytes()},
+	}
+
+	// the limit ends the prefix inside the second "go"
+	opts := []Option{WithFS(fsys), WithDecompressAuto(true), WithMaxBytesPerFile(9)}
+	_, perFile, err := CountTagDetailed(".", "go", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"a.json": 1, "b.json.gz": 1}; !reflect.DeepEqual(perFile, want) {
+		t.Errorf("counts = %v, want %v", perFile, want)
+	}
+
+	sums, err := MD5All(".", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, sum := range sums {
+		if want := md5.Sum([]byte(raw[:9])); sum != want {
+			t.Errorf("sum of %s = %x, want the sum of its prefix %x", path, sum, want)
+		}
+	}
+
+	_, perFile, err = CountTagDetailed(".", "go", WithFS(fsys), WithDecompressAuto(true), WithMaxBytesPerFile(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"a.json": 2, "b.json.gz": 200}; !reflect.DeepEqual(perFile, want) {
+		t.Errorf("unlimited counts = %v, want %v", perFile, want)
+	}
+}
+
+func TestMmap(t *testing.T) {
+	path, want := hugeFile(t, 2*mmapMinSize)
+	root := filepath.Dir(path)
+	small := filepath.Join(root, "small.json")
+	if err := os.WriteFile(small, []byte(`["go", "go"]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fsys := os.DirFS(root)
+
+	for _, mmap := range []bool{false, true} {
+		_, perFile, err := CountTagDetailed(root, "go", WithMmap(mmap))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perFile[path] != want || perFile[small] != 2 {
+			t.Errorf("mmap %v: counts = %v, want %d in huge.json and 2 in small.json", mmap, perFile, want)
+		}
+
+		// files not on the operating system's file system are read as usual
+		_, perFile, err = CountTagDetailed(".", "go", WithMmap(mmap), WithFS(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perFile["huge.json"] != want {
+			t.Errorf("mmap %v: count in an fs.FS = %d, want %d", mmap, perFile["huge.json"], want)
+		}
+
+		sums, err := MD5All(root, WithMmap(mmap))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sums[path] != md5.Sum(data) {
+			t.Errorf("mmap %v: sum = %x, want %x", mmap, sums[path], md5.Sum(data))
+		}
+	}
+}
+
+func BenchmarkMmap(b *testing.B) {
+	path, _ := hugeFile(b, 64<<20)
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%v", mmap), func(b *testing.B) {
+			o := newOptions([]Option{WithMmap(mmap)})
+			for i := 0; i < b.N; i++ {
+				if _, err := countTagInFile(path, "go", o); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
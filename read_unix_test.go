@@ -0,0 +1,79 @@
+//go:build unix
+
+package tagpipe
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNamedPipeSkipped(t *testing.T) {
+	root := writeTree(t, map[string]string{"a.json": `["go"]`})
+	fifo := filepath.Join(root, "fifo.json")
+	if err := syscall.Mkfifo(fifo, 0o644); err != nil {
+		t.Skip("can't make a named pipe:", err)
+	}
+
+	type result struct {
+		m   map[string]int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		_, m, err := CountTagDetailed(root, "go")
+		done <- result{m, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if _, ok := r.m[fifo]; ok || len(r.m) != 1 {
+			t.Errorf("counts = %v, want only a.json", r.m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan blocked on a named pipe")
+	}
+
+	// even when the walk is bypassed, the pipe is refused rather than read
+	if _, err := openFile(fifo, newOptions(nil)); err == nil {
+		t.Error("opened a named pipe")
+	}
+	m, err := CountTagsInFiles([]string{fifo}, "go", 1)
+	if err != nil || len(m) != 0 {
+		t.Errorf("CountTagsInFiles = %v, %v, want no counts", m, err)
+	}
+}
+
+func TestMmapMapsLargeFiles(t *testing.T) {
+	path, _ := hugeFile(t, mmapMinSize)
+	small := filepath.Join(filepath.Dir(path), "small.json")
+	if err := os.WriteFile(small, []byte(`["go"]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		mmap   bool
+		mapped bool
+	}{
+		{path, true, true},
+		{path, false, false},
+		{small, true, false},
+	} {
+		f, err := openFile(tt.path, newOptions([]Option{WithMmap(tt.mmap)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, mapped := f.(readCloser).Closer.(mappedFile)
+		if mapped != tt.mapped {
+			t.Errorf("%s with mmap %v: mapped %v, want %v", filepath.Base(tt.path), tt.mmap, mapped, tt.mapped)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
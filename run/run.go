@@ -3,8 +3,8 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"os"
 	"strings"
 	"time"
 
@@ -30,7 +30,7 @@ func main() {
 
 	if flag.NFlag() > 0 || flag.NArg() == 0 { // parse arguments from 'configPath'
 		log.Println("Fetching tags from the file:", configPath)
-		dat, err := ioutil.ReadFile(configPath)
+		dat, err := os.ReadFile(configPath)
 		if err != nil {
 			log.Fatalln("ReadFile returned error:", err)
 			flag.PrintDefaults()
@@ -0,0 +1,59 @@
+package tagpipe
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"sync"
+)
+
+// scannerRegexps is the number of compiled patterns a Scanner keeps at most
+const scannerRegexps = 256
+
+// scannerBufferSize is the size of the read buffers a Scanner reuses
+const scannerBufferSize = 32 << 10
+
+// Scanner runs the same scan many times, as in a watch loop, configured once
+// with options rather than on every call. It keeps the patterns it compiles
+// for tags and the buffers it reads files through from one call to the next,
+// so repeated scans don't compile or allocate them again. The state of a run,
+// such as its rate limit or pruned directories, starts afresh each time.
+// A Scanner is safe for concurrent use.
+type Scanner struct {
+	opts    []Option
+	regexps regexpCache
+	bufs    sync.Pool
+}
+
+// NewScanner returns a Scanner running with opts
+func NewScanner(opts ...Option) *Scanner {
+	s := &Scanner{opts: append([]Option(nil), opts...)}
+	s.regexps.max = scannerRegexps
+	s.bufs.New = func() any { return bufio.NewReaderSize(nil, scannerBufferSize) }
+	return s
+}
+
+// options returns the options of a call, sharing the compiled patterns and read
+// buffers of s
+func (s *Scanner) options() []Option {
+	return append(s.opts[:len(s.opts):len(s.opts)], func(o *Options) {
+		o.regexps, o.bufs = &s.regexps, &s.bufs
+	})
+}
+
+// CountFile returns the number of occurrences of tag in the file at path
+func (s *Scanner) CountFile(path, tag string) (int, error) {
+	return countTagInFile(path, tag, newOptions(s.options()))
+}
+
+// CountTree walks the file tree rooted at root and returns the count of tag in
+// each file, including files where it's 0
+func (s *Scanner) CountTree(root, tag string) (map[string]int, error) {
+	return countTagPerFile(context.Background(), root, tag, s.options())
+}
+
+// Hash walks the file tree rooted at root and returns the MD5 sum of each file,
+// as MD5All does
+func (s *Scanner) Hash(root string) (map[string][md5.Size]byte, error) {
+	return MD5All(root, s.options()...)
+}
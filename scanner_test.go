@@ -0,0 +1,143 @@
+package tagpipe
+
+import (
+	"crypto/md5"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+)
+
+func TestScanner(t *testing.T) {
+	s := NewScanner(WithRelativePaths(true), WithNormalizeSlashes(true))
+
+	a := writeTree(t, map[string]string{"x.json": `["go", "go"]`, "sub/y.json": `["go"]`})
+	b := writeTree(t, map[string]string{"x.json": `["rust"]`})
+
+	for i, tt := range []struct {
+		root string
+		want map[string]int
+	}{
+		{a, map[string]int{"x.json": 2, "sub/y.json": 1}},
+		{b, map[string]int{"x.json": 0}},
+		{a, map[string]int{"x.json": 2, "sub/y.json": 1}},
+	} {
+		got, err := s.CountTree(tt.root, "go")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("run %d: counts = %v, want %v", i+1, got, tt.want)
+		}
+	}
+
+	if n, err := s.CountFile(filepath.Join(a, "x.json"), "go"); err != nil || n != 2 {
+		t.Errorf("CountFile = %d, %v, want 2", n, err)
+	}
+	sums, err := s.Hash(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][md5.Size]byte{"x.json": md5.Sum([]byte(`["rust"]`))}; !reflect.DeepEqual(sums, want) {
+		t.Errorf("Hash = %x, want %x", sums, want)
+	}
+}
+
+func TestScannerRunsStartAfresh(t *testing.T) {
+	opts := []Option{WithSubtreeErrorPolicy(true)}
+	s := NewScanner(opts...)
+	opts[0] = WithMaxFiles(1) // the Scanner keeps its own copy
+
+	files := fstest.MapFS{
+		"dir/a.json": {Data: []byte(`["go"]`)},
+		"dir/b.json": {Data: []byte(`["go"]`)},
+	}
+	unreadable := partlyUnreadableFS{files, map[string]bool{"dir/a.json": true}}
+
+	// the first run prunes dir, which must not stay pruned for the next
+	got, err := NewScanner(append(s.opts, WithFS(unreadable))...).CountTree(".", "go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["dir/a.json"]; ok {
+		t.Errorf("counts = %v, want dir/a.json skipped", got)
+	}
+
+	s = NewScanner(append(s.opts, WithFS(files))...)
+	for i := 0; i < 2; i++ {
+		got, err := s.CountTree(".", "go")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]int{"dir/a.json": 1, "dir/b.json": 1}; !reflect.DeepEqual(got, want) {
+			t.Errorf("run %d: counts = %v, want %v", i+1, got, want)
+		}
+	}
+
+	// nor between runs of one Scanner
+	s = NewScanner(WithSubtreeErrorPolicy(true), WithFS(unreadable))
+	for i := 0; i < 2; i++ {
+		if _, err := s.CountTree(".", "go"); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := s.CountFile("dir/b.json", "go"); err != nil || n != 1 {
+			t.Errorf("run %d: CountFile in a directory pruned before = %d, %v, want 1", i+1, n, err)
+		}
+	}
+	if _, err := s.CountFile("dir/a.json", "go"); !errors.Is(err, errReadFailed) {
+		t.Errorf("CountFile of the unreadable file: err = %v, want the read error", err)
+	}
+}
+
+func TestScannerReusesPatternsAndBuffers(t *testing.T) {
+	root := writeTree(t, manyFiles(20))
+	s := NewScanner()
+	var news atomic.Int32
+	newBuf := s.bufs.New
+	s.bufs.New = func() any {
+		news.Add(1)
+		return newBuf()
+	}
+
+	var compiled *regexp.Regexp
+	for i := 0; i < 3; i++ {
+		if _, err := s.CountTree(root, "go"); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.regexps.m) != 1 {
+			t.Fatalf("run %d: %d patterns cached, want 1", i+1, len(s.regexps.m))
+		}
+		for _, re := range s.regexps.m {
+			if compiled != nil && re != compiled {
+				t.Errorf("run %d: pattern compiled again", i+1)
+			}
+			compiled = re
+		}
+	}
+
+	// one at a time, so each read can take the buffer the last put back
+	const runs = 20
+	news.Store(0)
+	for i := 0; i < runs; i++ {
+		if n, err := s.CountFile(filepath.Join(root, "d0/f0.json"), "go"); err != nil || n != 1 {
+			t.Fatalf("CountFile = %d, %v, want 1", n, err)
+		}
+	}
+	if n := news.Load(); n >= runs {
+		t.Errorf("%d read buffers allocated for %d reads, want them reused", n, runs)
+	}
+
+	// a Scanner's cache is bounded, as it lives across calls
+	c := regexpCache{max: 2}
+	for _, p := range []string{"a", "b", "c"} {
+		if _, err := c.compile(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.m) > 2 {
+		t.Errorf("%d patterns cached, want at most 2", len(c.m))
+	}
+}
@@ -0,0 +1,197 @@
+package tagpipe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// SchemaError is a JSON document failing a constraint of a JSON schema at Path,
+// a JSON pointer into the document such as "/items/0/name"
+type SchemaError struct {
+	Path string
+	Msg  string
+}
+
+func (e *SchemaError) Error() string {
+	return pointerOrRoot(e.Path) + ": " + e.Msg
+}
+
+// pointerOrRoot returns the JSON pointer path, written as "/" for the root
+func pointerOrRoot(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// ErrUnsupportedSchema is the error of a schema referring to other documents,
+// which ValidateJSONSchema doesn't load, so refuses rather than ignore and
+// pass documents the schema doesn't allow
+var ErrUnsupportedSchema = errors.New("unsupported schema")
+
+// schemaURL is the location schemas are compiled from, which references to
+// other documents are resolved against
+const schemaURL = "tagpipe:///schema.json"
+
+// schemaPrinter writes the messages of SchemaErrors
+var schemaPrinter = message.NewPrinter(language.English)
+
+// ValidateJSONSchema checks the JSON document read from r against schema, a JSON
+// schema. It returns a syntax error if either isn't valid JSON, or the
+// failures of the document joined with errors.Join, each a *SchemaError.
+// Schemas are of the draft named by their $schema, 2020-12 if they name none,
+// and patterns are ECMA-262 regular expressions as the drafts specify. A
+// schema referring to other documents with $ref is refused with an error
+// wrapping ErrUnsupportedSchema.
+func ValidateJSONSchema(r io.Reader, schema []byte) error {
+	s, err := compileSchema(schema)
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return validateJSON(s, data)
+}
+
+// ValidateTreeJSONSchema walks the file tree rooted at root and checks every file
+// against schema like ValidateJSONSchema, returning the error of each file that
+// isn't valid JSON or doesn't conform to it
+func ValidateTreeJSONSchema(root string, schema []byte, opts ...Option) (map[string]error, error) {
+	s, err := compileSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	o := newOptions(opts)
+	c, errc := scanFiles(done, root, o, func(path string) Result {
+		data, err := readFile(path, o)
+		if err != nil {
+			return Result{Path: path, E: err}
+		}
+		return Result{Path: path, invalid: validateJSON(s, data)}
+	})
+
+	invalid := make(map[string]error)
+	for r := range c {
+		if r.E != nil {
+			if skipped(r) {
+				continue
+			}
+			return nil, r.E
+		}
+		if r.invalid != nil {
+			invalid[r.Path] = r.invalid
+		}
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return invalid, nil
+}
+
+// compileSchema compiles schema, refusing references to other documents
+func compileSchema(schema []byte) (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(schema))
+	if err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+
+	var loaded []string
+	c := jsonschema.NewCompiler()
+	c.DefaultDraft(jsonschema.Draft2020)
+	c.UseRegexpEngine(compileECMARegexp)
+	c.UseLoader(refusingLoader(func(url string) { loaded = append(loaded, url) }))
+	if err := c.AddResource(schemaURL, doc); err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+	s, err := c.Compile(schemaURL)
+	if len(loaded) > 0 {
+		return nil, fmt.Errorf("schema: %w: reference to %s", ErrUnsupportedSchema, loaded[0])
+	} else if err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+	return s, nil
+}
+
+// refusingLoader is a jsonschema.URLLoader loading no documents, calling itself
+// with the URL of each asked for
+type refusingLoader func(url string)
+
+func (l refusingLoader) Load(url string) (any, error) {
+	l(url)
+	return nil, ErrUnsupportedSchema
+}
+
+// ecmaRegexp is a pattern of a schema, an ECMA-262 regular expression
+type ecmaRegexp regexp2.Regexp
+
+func (re *ecmaRegexp) MatchString(s string) bool {
+	matched, err := (*regexp2.Regexp)(re).MatchString(s)
+	return err == nil && matched
+}
+
+func (re *ecmaRegexp) String() string {
+	return (*regexp2.Regexp)(re).String()
+}
+
+// compileECMARegexp is the jsonschema.RegexpEngine of ECMA-262 patterns
+func compileECMARegexp(pattern string) (jsonschema.Regexp, error) {
+	re, err := regexp2.Compile(pattern, regexp2.ECMAScript)
+	if err != nil {
+		return nil, err
+	}
+	return (*ecmaRegexp)(re), nil
+}
+
+// validateJSON checks the JSON document data against the compiled schema s
+func validateJSON(s *jsonschema.Schema, data []byte) error {
+	v, err := jsonschema.UnmarshalJSON(bytes.NewReader(bytes.TrimPrefix(data, utf8BOM)))
+	if err != nil {
+		return err
+	}
+
+	var ve *jsonschema.ValidationError
+	if err := s.Validate(v); !errors.As(err, &ve) {
+		return err
+	}
+	var errs []error
+	schemaErrors(ve, &errs)
+	return errors.Join(errs...)
+}
+
+// schemaErrors appends the failures at the leaves of the tree of causes of e,
+// those naming what is wrong rather than the subschema that failed, to errs
+func schemaErrors(e *jsonschema.ValidationError, errs *[]error) {
+	if len(e.Causes) == 0 {
+		var path strings.Builder
+		for _, name := range e.InstanceLocation {
+			path.WriteString("/" + escapePointer(name))
+		}
+		*errs = append(*errs, &SchemaError{path.String(), e.ErrorKind.LocalizedString(schemaPrinter)})
+		return
+	}
+	for _, cause := range e.Causes {
+		schemaErrors(cause, errs)
+	}
+}
+
+// escapePointer escapes name for use as a JSON pointer reference token
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
@@ -0,0 +1,126 @@
+package tagpipe
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "package",
+	"type": "object",
+	"required": ["name", "tags"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "pattern": "^[a-z]+$"},
+		"version": {"type": "integer", "minimum": 1},
+		"tags": {"type": "array", "maxItems": 3, "items": {"enum": ["go", "rust", "zig"]}}
+	},
+	"additionalProperties": false
+}`
+
+func TestValidateJSONSchema(t *testing.T) {
+	tests := []struct {
+		doc   string
+		paths []string // of the failures, none when valid
+	}{
+		{`{"name": "tagpipe", "version": 2, "tags": ["go"]}`, nil},
+		{`{"name": "tagpipe", "tags": []}`, nil},
+		{`{"name": "Tag Pipe", "version": 1.5, "tags": ["go", "c"], "x": 1}`, []string{"/", "/name", "/tags/1", "/version"}},
+		{`{"tags": ["go", "go", "go", "go"]}`, []string{"/", "/tags"}},
+		{`["not", "an", "object"]`, []string{"/"}},
+	}
+	for _, tt := range tests {
+		err := ValidateJSONSchema(strings.NewReader(tt.doc), []byte(testSchema))
+		var paths []string
+		if err != nil {
+			for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+				var se *SchemaError
+				if !errors.As(e, &se) {
+					t.Fatalf("%s: error %v isn't a *SchemaError", tt.doc, e)
+				}
+				paths = append(paths, pointerOrRoot(se.Path))
+			}
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("%s: failures at %q, want %q: %v", tt.doc, paths, tt.paths, err)
+		}
+	}
+
+	if err := ValidateJSONSchema(strings.NewReader(`{"name": `), []byte(testSchema)); err == nil {
+		t.Error("no error for a document that isn't JSON")
+	}
+}
+
+func TestValidateJSONSchemaKeywords(t *testing.T) {
+	tests := []struct {
+		schema, doc string
+		valid       bool
+	}{
+		{`{"$ref": "#/$defs/x", "$defs": {"x": {"type": "string"}}}`, `"a"`, true},
+		{`{"$ref": "#/$defs/x", "$defs": {"x": {"type": "string"}}}`, `1`, false},
+		{`{"allOf": [{"type": "string"}, {"minLength": 2}]}`, `"a"`, false},
+		{`{"properties": {"a": {"anyOf": [{"type": "string"}, {"type": "null"}]}}}`, `{"a": null}`, true},
+		{`{"items": {"oneOf": [{"type": "string"}, {"const": 1}]}}`, `["a", 2]`, false},
+		{`{"additionalProperties": {"not": {"type": "string"}}}`, `{"a": "b"}`, false},
+		{`{"prefixItems": [{"type": "string"}], "items": false}`, `["a", "b"]`, false},
+		// ECMA-262 lookahead, which RE2 doesn't have
+		{`{"pattern": "^(?=.*\\d)[a-z\\d]+$"}`, `"abc1"`, true},
+		{`{"pattern": "^(?=.*\\d)[a-z\\d]+$"}`, `"abc"`, false},
+		// integers too large for float64 to hold exactly
+		{`{"maximum": 9007199254740992}`, `9007199254740993`, false},
+	}
+	for _, tt := range tests {
+		err := ValidateJSONSchema(strings.NewReader(tt.doc), []byte(tt.schema))
+		if (err == nil) != tt.valid {
+			t.Errorf("%s against %s: err = %v, want valid %v", tt.doc, tt.schema, err, tt.valid)
+		}
+	}
+}
+
+func TestValidateJSONSchemaUnsupported(t *testing.T) {
+	for _, schema := range []string{
+		`{"$ref": "other.json"}`,
+		`{"properties": {"a": {"$ref": "https://example.com/schema.json"}}}`,
+		`{"allOf": [{"$ref": "file:///etc/passwd"}]}`,
+	} {
+		err := ValidateJSONSchema(strings.NewReader(`{}`), []byte(schema))
+		if !errors.Is(err, ErrUnsupportedSchema) {
+			t.Errorf("%s: err = %v, want ErrUnsupportedSchema", schema, err)
+		}
+		if _, err := ValidateTreeJSONSchema(t.TempDir(), []byte(schema)); !errors.Is(err, ErrUnsupportedSchema) {
+			t.Errorf("%s: tree err = %v, want ErrUnsupportedSchema", schema, err)
+		}
+	}
+}
+
+// Run with -race, as files are validated concurrently
+func TestValidateTreeJSONSchema(t *testing.T) {
+	files := map[string]string{
+		"ok.json":      `{"name": "a", "tags": ["go"]}`,
+		"sub/ok.json":  `{"name": "b", "tags": []}`,
+		"missing.json": `{"name": "c"}`,
+		"sub/bad.json": `{"name": "d", "tags": ["c"]}`,
+		"broken.json":  `{"name"`,
+	}
+	for i := 0; i < 50; i++ {
+		files["many/"+strings.Repeat("x", i+1)+".json"] = `{"name": "e", "tags": ["zig"]}`
+	}
+	root := writeTree(t, files)
+
+	invalid, err := ValidateTreeJSONSchema(root, []byte(testSchema), WithRelativePaths(true), WithNormalizeSlashes(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for path := range invalid {
+		got = append(got, path)
+	}
+	sort.Strings(got)
+	if want := []string{"broken.json", "missing.json", "sub/bad.json"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid files %q, want %q", got, want)
+	}
+}
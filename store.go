@@ -0,0 +1,41 @@
+package tagpipe
+
+import "sync"
+
+// ResultStore receives the tag counts of each file as a tree is scanned, so
+// results can be streamed to storage rather than kept in memory. To persist to
+// a database, implement Put with an upsert keyed by path, e.g. an INSERT OR
+// REPLACE into a SQLite table of (path, tag, count) rows in one transaction,
+// or a Put of the JSON encoded counts into a key-value store.
+type ResultStore interface {
+	Put(path string, counts TList) error
+}
+
+// MemoryStore is a ResultStore keeping results in memory, safe for concurrent use
+type MemoryStore struct {
+	mu sync.Mutex
+	m  map[string]TList
+}
+
+// Put stores counts for path, replacing what was stored before
+func (s *MemoryStore) Put(path string, counts TList) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]TList)
+	}
+	s.m[path] = counts
+	return nil
+}
+
+// Results returns a copy of the stored results, by path
+func (s *MemoryStore) Results() map[string]TList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := make(map[string]TList, len(s.m))
+	for path, counts := range s.m {
+		m[path] = append(TList(nil), counts...)
+	}
+	return m
+}
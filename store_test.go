@@ -0,0 +1,69 @@
+package tagpipe
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeStore records the calls to Put
+type fakeStore struct {
+	mu   sync.Mutex
+	puts map[string][]TList
+}
+
+func (s *fakeStore) Put(path string, counts TList) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.puts == nil {
+		s.puts = make(map[string][]TList)
+	}
+	s.puts[path] = append(s.puts[path], counts)
+	return nil
+}
+
+func TestScanTreeResultStore(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json":     `["go", "go", "rust"]`,
+		"b.json":     `{}`,
+		"sub/c.json": `["rust"]`,
+	})
+
+	var store fakeStore
+	if _, err := ScanTree(context.Background(), root, []string{"go", "rust"}, WithResultStore(&store)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]TList{
+		filepath.Join(root, "a.json"):        {{"go", 2}, {"rust", 1}},
+		filepath.Join(root, "b.json"):        {},
+		filepath.Join(root, "sub", "c.json"): {{"rust", 1}},
+	}
+	if len(store.puts) != len(want) {
+		t.Fatalf("Put called for %d paths, want %d: %v", len(store.puts), len(want), store.puts)
+	}
+	for path, counts := range want {
+		calls := store.puts[path]
+		if len(calls) != 1 {
+			t.Errorf("%s: Put called %d times, want once", path, len(calls))
+			continue
+		}
+		if got := calls[0]; len(got) != len(counts) || len(got) > 0 && !reflect.DeepEqual(got, counts) {
+			t.Errorf("%s: counts %v, want %v", path, got, counts)
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	var s MemoryStore
+	s.Put("a.json", TList{{"go", 1}})
+	s.Put("a.json", TList{{"go", 2}})
+
+	res := s.Results()
+	res["a.json"][0].Count = 100
+	if want := map[string]TList{"a.json": {{"go", 2}}}; !reflect.DeepEqual(s.Results(), want) {
+		t.Errorf("Results() = %v, want %v", s.Results(), want)
+	}
+}
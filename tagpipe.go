@@ -1,17 +1,21 @@
 package tagpipe
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"hash"
+	"io"
+	"io/fs"
 	"log"
-	"os"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -20,13 +24,26 @@ import (
 // about digestion result and tag count map of the file it corresponds to
 type Result struct {
 	Path string
-	Sum  string
+	Sum  string // hex encoded MD5 sum, empty when E is set
+	Size int64
 	E    error
 	T    map[string]int
+
+	invalid error       // why the file fails ValidateTreeJSONSchema, if it does
+	lines   []MatchLine // the lines GrepTree found the tag on
+	weight  float64     // the count CountTagsRecencyWeighted weighted by age
 }
 
-// cacheMap is used to cache parsed files, to avoid parsing the same file again
-var cacheMap map[string]Result
+// ErrWalkCanceled is the result of a walk abandoned because its caller is done
+var ErrWalkCanceled = errors.New("walk canceled")
+
+// ErrFileTimeout is the error of a file skipped because reading it took longer than
+// Options.PerFileTimeout
+var ErrFileTimeout = errors.New("read timed out")
+
+// ErrSubtreePruned is wrapped by the error of a file whose directory wasn't
+// scanned further because of it, with Options.PruneOnError
+var ErrSubtreePruned = errors.New("directory pruned")
 
 // Becomes false when user disables cache via command line flags
 var uc bool // use cache
@@ -56,102 +73,481 @@ func sortByTagCount(tagFrequencies map[string]int) TList {
 	return tl
 }
 
+// BottomN returns the n least common tags in counts, in ascending order of count
+// with ties broken by tag. It returns all of counts when n exceeds its length,
+// and none when n <= 0. counts is left as is.
+func BottomN(counts TList, n int) TList {
+	if n <= 0 {
+		return TList{}
+	}
+
+	tl := append(TList(nil), counts...)
+	sort.Slice(tl, func(i, j int) bool {
+		if tl[i].Count != tl[j].Count {
+			return tl[i].Count < tl[j].Count
+		}
+		return tl[i].Tag < tl[j].Tag
+	})
+	if n < len(tl) {
+		tl = tl[:n]
+	}
+	return tl
+}
+
+// Paginate returns the window of up to limit tag counts starting at offset, with
+// counts sorted by descending count and then by tag so pages are stable.
+// Negative offsets and limits are taken as 0, and an offset past the end
+// returns no counts. counts is left as is.
+func Paginate(counts TList, offset, limit int) TList {
+	offset, limit = max(offset, 0), max(limit, 0)
+	if offset >= len(counts) {
+		return TList{}
+	}
+
+	tl := append(TList(nil), counts...)
+	sort.Slice(tl, func(i, j int) bool { return sortsBefore(tl[i], tl[j]) })
+	if limit < len(tl)-offset {
+		return tl[offset : offset+limit]
+	}
+	return tl[offset:]
+}
+
+// SortTagCountsBy sorts counts in place by less, for orders other than by count
+// such as by tag or by length of tag
+func SortTagCountsBy(counts TList, less func(a, b T) bool) {
+	sort.Slice(counts, func(i, j int) bool { return less(counts[i], counts[j]) })
+}
+
+// IncrementTagCount adds one to the count of tag in counts, appending it with a
+// count of 1 if it's not there, and returns the possibly grown slice. It looks
+// tag up in O(n) and isn't safe for concurrent use, so prefer a Counter for
+// many tags or goroutines.
+func IncrementTagCount(counts TList, tag string) TList {
+	for i := range counts {
+		if counts[i].Tag == tag {
+			counts[i].Count++
+			return counts
+		}
+	}
+	return append(counts, T{tag, 1})
+}
+
+// CaseVariants groups the tags in counts that differ only in case, such as "TODO"
+// and "todo", by their lower case, for finding inconsistent tags. Tags without
+// other variants are left out. Each group is sorted.
+func CaseVariants(counts TList) map[string][]string {
+	groups := make(map[string][]string)
+	for _, t := range counts {
+		lower := strings.ToLower(t.Tag)
+		if !slices.Contains(groups[lower], t.Tag) {
+			groups[lower] = append(groups[lower], t.Tag)
+		}
+	}
+
+	for lower, tags := range groups {
+		if len(tags) < 2 {
+			delete(groups, lower)
+			continue
+		}
+		sort.Strings(tags)
+	}
+	return groups
+}
+
+// Counter accumulates tag counts, it's safe to share between goroutines
+type Counter struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+// Add adds n to the count of tag
+func (c *Counter) Add(tag string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]int)
+	}
+	c.m[tag] += n
+}
+
+// Snapshot returns the counts accumulated so far, sorted by count
+func (c *Counter) Snapshot() TList {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return sortByTagCount(c.m)
+}
+
 // walkFiles starts a goroutine to walk the directory tree at root and send the
 // path of each regular file on the string channel.  It sends the result of the
 // walk on the error channel.  If done is closed, walkFiles abandons its work.
-func walkFiles(done <-chan struct{}, root string) (<-chan string, <-chan error, int) {
+func walkFiles(done <-chan struct{}, root string, o *Options) (<-chan string, <-chan error, int) {
 	paths := make(chan string)
 	errc := make(chan error, 1)
 
+	fsys := o.fsys()
+
 	// used to optimize digester count
-	files, _ := ioutil.ReadDir(root)
+	files, _ := fs.ReadDir(fsys, root)
 
 	go func() { // HL
 		// Close the paths channel after Walk returns.
 		defer close(paths) // HL
-		// No select needed for this send, since errc is buffered.
-		errc <- filepath.Walk(root, func(path string, info os.FileInfo, err error) error { // HL
+
+		sent := 0
+		err := fs.WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error { // HL
+			// paths below root may be removed by others while we walk
+			disappeared := func(err error) bool {
+				return o.TolerateDisappearing && path != root && errors.Is(err, fs.ErrNotExist)
+			}
+
 			if err != nil {
+				if disappeared(err) {
+					log.Println("skipping disappeared path", path)
+					return nil
+				}
+				if o.pruned != nil && path != root {
+					log.Println("pruning directory,", err)
+					return fs.SkipDir // the directory of a file, or the directory itself
+				}
 				return err
 			}
-			if !info.Mode().IsRegular() {
+			if d.IsDir() && o.tooDeep(root, path) {
+				return fs.SkipDir
+			}
+			if o.pruned.has(path) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if d.Type()&skippedModes != 0 {
 				return nil
 			}
+			if o.NameRegex != nil && !o.NameRegex.MatchString(d.Name()) {
+				return nil
+			}
+			if !d.IsDir() && !o.sampled(root, path) {
+				return nil
+			}
+			if !o.ModifiedAfter.IsZero() {
+				info, err := d.Info()
+				if err != nil {
+					if disappeared(err) {
+						log.Println("skipping disappeared path", path)
+						return nil
+					}
+					return err
+				}
+				if info.ModTime().Before(o.ModifiedAfter) {
+					return nil
+				}
+			}
 			select {
 			case paths <- path: // HL
 			case <-done: // HL
-				return errors.New("walk canceled")
+				return ErrWalkCanceled
+			}
+			if sent++; o.MaxFiles > 0 && sent == o.MaxFiles {
+				return fs.SkipAll
 			}
 			return nil
 		})
+
+		// errc is buffered and sent on once, so the send can't block, even for
+		// a caller that returned early and never reads it. Racing it against
+		// done would lose ErrWalkCanceled. Closing errc lets any repeated read
+		// see nil rather than block.
+		errc <- err
+		close(errc)
 	}()
 	return paths, errc, len(files)
 }
 
 // digester reads path names from paths and sends digests of the corresponding
 // files on c until either paths or done is closed.
-func digester(done <-chan struct{}, paths <-chan string, c chan<- Result, tags []string) {
+func digester(done <-chan struct{}, paths <-chan string, c chan<- Result, tags []string, o *Options) {
 
 	for path := range paths { // HLpaths
-		data, err := ioutil.ReadFile(path)
-
-		tM := make(map[string]int) // tag map keeping total counts
+		if uc {
+			// hash the file as a stream first, so cache hits never read it into memory
+			bytesMD5, _, err := md5File(path, o)
+			if err != nil {
+				// no digest, rather than the sum of whatever was read
+				sendResult(done, c, Result{Path: path, E: err})
+				continue
+			}
+			if savedResult, ok := DefaultCache.get(hex.EncodeToString(bytesMD5[:])); ok {
+				log.Println("identical file found in cache", path)
+				sendResult(done, c, savedResult)
+				continue
+			}
+		}
 
-		// TODO before parsing tags, check if the file was processed before
-		// skip if file is found in cache
-		bytesMD5 := md5.Sum(data)
-		sumMD5 := hex.EncodeToString(bytesMD5[:])
-		savedResult, ok := cacheMap[sumMD5]
+		data, err := readFile(path, o)
+		if err != nil {
+			sendResult(done, c, Result{Path: path, E: err})
+			continue
+		}
 
-		if uc && ok {
-			log.Println("identical file found in cache", path)
-			c <- savedResult
+		// discard files containing invalid JSON, a byte order mark isn't part of it
+		if !IsValidJSON(string(bytes.TrimPrefix(data, utf8BOM))) {
+			log.Println("skipping file ", path, " with invalid JSON")
 			continue
 		}
 
-		// discard files containing invalid JSON
-		fileHasValidJSON := IsValidJSON(string(data))
+		// cached under the sum of what was parsed, which may differ from what
+		// was hashed above if the file changed in between
+		result := parseData(path, data, tags, o)
+		if uc && result.E == nil {
+			DefaultCache.put(result.Sum, result)
+		}
 
-		if fileHasValidJSON {
+		select {
+		case <-done:
+			return
+		default:
+			c <- result
+		}
+	}
+}
 
-			for _, tag := range tags {
-				r, _ := regexp.Compile("\"" + tag + "\"")
-				c := len(r.FindAllStringIndex(string(data), -1))
-				if c > 0 {
-					tM[tag] += c
+// sendResult sends r on c unless done is closed first
+func sendResult(done <-chan struct{}, c chan<- Result, r Result) {
+	select {
+	case c <- r:
+	case <-done:
+	}
+}
+
+// digesterCount returns how many digesters to start for a root path holding fc
+// files. It's as many as the files, with an upper limit 20, and at least one so
+// that the walk is always drained, even when root has no entries of its own or
+// is a regular file.
+func digesterCount(fc int) int {
+	if fc > 20 {
+		return 20
+	}
+	if fc < 1 {
+		return 1
+	}
+	return fc
+}
+
+// scanFiles walks the file tree rooted at root and calls fn for each regular file
+// on a bounded number of goroutines, sending what it returns on the result
+// channel keyed as o asks. The result channel is closed once every file is
+// processed or done is closed, after which the result of the walk can be
+// received on the error channel.
+func scanFiles(done <-chan struct{}, root string, o *Options, fn func(path string) Result) (<-chan Result, <-chan error) {
+	paths, errc, fc := walkFiles(done, root, o)
+	return processFiles(done, paths, digesterCount(fc), root, o, fn), errc
+}
+
+// processFiles calls fn for each path received from paths on numDigesters
+// goroutines, sending what it returns on the result channel keyed as o asks.
+// The result channel is closed once paths is drained or done is closed.
+func processFiles(done <-chan struct{}, paths <-chan string, numDigesters int, root string, o *Options, fn func(path string) Result) <-chan Result {
+	c := make(chan Result)
+	var wg sync.WaitGroup
+	wg.Add(numDigesters)
+	for i := 0; i < numDigesters; i++ {
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				// a file read earlier in its directory failed
+				if o.pruned.has(path) {
+					continue
 				}
-			}
 
-			if uc {
-				if cacheMap == nil {
-					cacheMap = map[string]Result{}
+				var r Result
+				if o.PerFileTimeout > 0 {
+					r = runWithTimeout(path, o.PerFileTimeout, fn)
+				} else {
+					r = fn(path)
+				}
+				// only files failing to be read, not tags failing to compile
+				if r.E != nil && o.pruned != nil && errors.As(r.E, new(*fs.PathError)) && !errors.Is(r.E, ErrFileTimeout) {
+					dir := filepath.Dir(path)
+					o.pruned.add(dir)
+					r.E = fmt.Errorf("%w %s: %w", ErrSubtreePruned, dir, r.E)
+				}
+				r.Path = o.key(root, path)
+				select {
+				case c <- r:
+				case <-done:
+					return
 				}
-				cacheMap[sumMD5] = Result{path, sumMD5, err, tM}
 			}
+		}()
+	}
 
-		} else {
-			log.Println("skipping file ", path, " with invalid JSON")
-			continue
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
+
+	return c
+}
+
+// runWithTimeout calls fn for path, giving up on it once d has passed, as when the
+// file is stuck on a flaky network mount. fn keeps running on its own goroutine
+// until it returns, its result then discarded.
+func runWithTimeout(path string, d time.Duration, fn func(path string) Result) Result {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	rc := make(chan Result, 1)
+	go func() { rc <- fn(path) }()
+
+	select {
+	case r := <-rc:
+		return r
+	case <-ctx.Done():
+		return Result{Path: path, E: &fs.PathError{Op: "read", Path: path, Err: ErrFileTimeout}}
+	}
+}
+
+// skipped reports whether r is of a file skipped rather than failing the scan it's
+// part of, as one that timed out, logging why if so
+func skipped(r Result) bool {
+	if errors.Is(r.E, ErrFileTimeout) || errors.Is(r.E, ErrSubtreePruned) {
+		log.Println("skipping file,", r.E)
+		return true
+	}
+	return false
+}
+
+// md5File returns the MD5 sum of the file at path along with its size, reading
+// it as a stream. On error the sum is zero and must not be used.
+func md5File(path string, o *Options) ([md5.Size]byte, int64, error) {
+	var sum [md5.Size]byte
+
+	h := md5.New()
+	n, err := hashFile(path, o, h)
+	if err != nil {
+		return sum, 0, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, n, nil
+}
+
+// hashFile writes the contents of the file at path to h, returning its size
+func hashFile(path string, o *Options, h hash.Hash) (int64, error) {
+	f, err := openFile(path, o)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	br, release := o.readBuffer(f)
+	defer release()
+	return io.Copy(h, br)
+}
+
+// ParseFile reads the file at path and returns its digest along with the counts
+// of tags in it, matched according to opts. Tags that don't appear in the file
+// are left out of Result.T, unless IncludeZeros is set.
+func ParseFile(path string, tags []string, opts ...Option) (Result, error) {
+	o := newOptions(opts)
+	tags, err := normalizeTags(tags, o)
+	if err != nil {
+		return Result{Path: path, E: err}, err
+	}
+	r := parsePath(path, tags, o)
+	return r, r.E
+}
+
+// parsePath is ParseFile with options already applied and tags normalized, errors
+// are set in Result.E
+func parsePath(path string, tags []string, o *Options) Result {
+	if o.SinglePass {
+		return parseStream(path, tags, o)
+	}
+
+	data, err := readFile(path, o)
+	if err != nil {
+		return Result{Path: path, E: err}
+	}
+	r := parseData(path, data, tags, o)
+	if o.IncludeZeros && r.E == nil {
+		addZeros(r.T, tags)
+	}
+	return r
+}
+
+// addZeros adds the tags missing from t with a count of 0
+func addZeros(t map[string]int, tags []string) {
+	for _, tag := range tags {
+		if _, ok := t[tag]; !ok {
+			t[tag] = 0
 		}
+	}
+}
 
-		select {
-		case <-done:
-			return
-		default:
-			// Path string
-			// Sum  string
-			// E  error
-			// T map[string]int
-			c <- Result{Path: path, Sum: sumMD5, E: err, T: tM}
+// parseStream is ParseFile in a single pass over the file, without holding it in
+// memory. The file is read line by line to count tags, while what's read is
+// teed to the hash.
+func parseStream(path string, tags []string, o *Options) Result {
+	matchers := make([]matcher, len(tags))
+	for i, tag := range tags {
+		m, err := newMatcher(tag, o)
+		if err != nil {
+			return Result{Path: path, E: err}
+		}
+		matchers[i] = m
+	}
+
+	f, err := openFile(path, o)
+	if err != nil {
+		return Result{Path: path, E: err}
+	}
+	defer f.Close()
+
+	h := md5.New()
+	cr := &countingReader{r: io.TeeReader(f, h)}
+
+	filter := newLineFilter(o)
+	tM := make(map[string]int) // tag map keeping total counts
+	err = eachLine(cr, func(line []byte) error {
+		line = filter(line)
+		for i, match := range matchers {
+			if c := match(line); c > 0 {
+				tM[tags[i]] += c
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Result{Path: path, E: err}
+	}
+	if o.IncludeZeros {
+		addZeros(tM, tags)
+	}
+	return Result{Path: path, Sum: hex.EncodeToString(h.Sum(nil)), Size: cr.n, T: tM}
+}
+
+// parseData is ParseFile over data already read from path, tags matched in it
+// according to o
+func parseData(path string, data []byte, tags []string, o *Options) Result {
+	sum := md5.Sum(data)
+
+	tM := make(map[string]int) // tag map keeping total counts
+	for _, tag := range tags {
+		c, err := countReader(bytes.NewReader(data), tag, o)
+		if err != nil {
+			return Result{Path: path, E: err}
+		}
+		if c > 0 {
+			tM[tag] += c
 		}
 	}
+	return Result{Path: path, Sum: hex.EncodeToString(sum[:]), Size: int64(len(data)), T: tM}
 }
 
 // DigestAllFiles reads all the files in the file tree rooted at root and returns a map
 // from file path to the MD5 sum of the file's contents.  If the directory walk
 // fails or any read operation fails, DigestAllFiles returns an error.  In that case,
 // DigestAllFiles does not wait for inflight read operations to complete.
-func DigestAllFiles(root string, tags []string, useCache bool) (TList, error) {
+func DigestAllFiles(root string, tags []string, useCache bool, opts ...Option) (TList, error) {
 	defer TimeTrack(time.Now(), "DigestAllFiles")
 
 	// DigestAllFiles closes the done channel when it returns; it may do so before
@@ -159,28 +555,34 @@ func DigestAllFiles(root string, tags []string, useCache bool) (TList, error) {
 	done := make(chan struct{})
 	defer close(done)
 
+	o := newOptions(opts)
+	tags, err := normalizeTags(tags, o)
+	if err != nil {
+		return nil, err
+	}
+
 	// prepare cache
 	uc = useCache
 	if uc {
-		cacheMap = LoadCache()
+		m, err := LoadCache()
+		if err != nil {
+			log.Println(err, ", creating new cache")
+		}
+		DefaultCache.reset(m)
 	}
 
-	paths, errc, fc := walkFiles(done, root)
+	paths, errc, fc := walkFiles(done, root, o)
 
 	// Start a fixed number of goroutines to read and digest files.
 	c := make(chan Result) // HLc
 	var wg sync.WaitGroup
 
-	// create as many digesters as the number of files in root path, with an upper limit 20
-	numDigesters := fc
-	if numDigesters > 20 {
-		numDigesters = 20
-	}
+	numDigesters := digesterCount(fc)
 
 	wg.Add(numDigesters)
 	for i := 0; i < numDigesters; i++ {
 		go func() {
-			digester(done, paths, c, tags) // HLc
+			digester(done, paths, c, tags, o) // HLc
 			wg.Done()
 		}()
 	}
@@ -190,7 +592,7 @@ func DigestAllFiles(root string, tags []string, useCache bool) (TList, error) {
 		close(c)
 	}()
 
-	m := make(map[string]int)
+	var counter Counter
 	for r := range c {
 		if r.E != nil {
 			return nil, r.E
@@ -207,63 +609,54 @@ func DigestAllFiles(root string, tags []string, useCache bool) (TList, error) {
 
 			fmt.Println(t, i)
 
-			m[t] += r.T[t]
+			counter.Add(t, i)
 		}
 	}
 
 	// override cache
-	log.Println("saving cache..", SaveCache(cacheMap))
+	log.Println("saving cache..", SaveCache(DefaultCache.Snapshot()))
 
 	// Check whether the Walk failed.
 	if err := <-errc; err != nil { // HLerrc
 		return nil, err
 	}
 
-	return sortByTagCount(m), nil
+	return counter.Snapshot(), nil
 }
 
-// LoadCache tries to parse a previously saved cache file
-func LoadCache() map[string]Result {
-	defer TimeTrack(time.Now(), "LoadCache")
+// IsValidJSON checks if the given string has a valid JSON format, generalized
+func IsValidJSON(s string) bool {
+	_, err := ParseJSON(s)
+	return err == nil
+}
 
-	dat, e1 := ioutil.ReadFile("cache")
-	if e1 != nil {
-		log.Println(e1, ", creating new cache")
-		return nil
+// ParseJSON decodes the JSON in s, as json.Unmarshal does into an interface{},
+// for callers who need the value as well as to know it's valid
+func ParseJSON(s string) (interface{}, error) {
+	var js interface{}
+	if err := json.Unmarshal([]byte(s), &js); err != nil {
+		return nil, err
 	}
+	return js, nil
+}
 
-	if e2 := json.Unmarshal(dat, &cacheMap); e2 != nil {
-		if cacheMap == nil {
-			cacheMap = make(map[string]Result)
+// IsValidNDJSON checks if every non-empty line read from r is valid JSON, as in
+// newline delimited JSON. When a line isn't, it returns false along with the
+// index of that line, counting from 0. Blank lines are allowed anywhere.
+func IsValidNDJSON(r io.Reader) (bool, int, error) {
+	i, invalid := 0, -1
+	err := eachLine(r, func(line []byte) error {
+		if len(bytes.TrimSpace(line)) > 0 && !json.Valid(line) {
+			invalid = i
+			return errStop
 		}
+		i++
 		return nil
+	})
+	if err != nil && err != errStop {
+		return false, -1, err
 	}
-
-	return cacheMap
-}
-
-// SaveCache will save parsing results of all files in a file named "cache"
-func SaveCache(cache map[string]Result) bool {
-	defer TimeTrack(time.Now(), "SaveCache")
-
-	// marshall cache into JSON array
-	cacheJSON, errj := json.Marshal(cache)
-	if errj != nil {
-		log.Println(errj)
-		return false
-	}
-
-	err := ioutil.WriteFile("cache", cacheJSON, 0644)
-	if err != nil {
-		return false
-	}
-	return true
-}
-
-// IsValidJSON checks if the given string has a valid JSON format, generalized
-func IsValidJSON(s string) bool {
-	var js interface{}
-	return json.Unmarshal([]byte(s), &js) == nil
+	return invalid < 0, invalid, nil
 }
 
 // TimeTrack utility to measure the elapsed time in ms
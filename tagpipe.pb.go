@@ -0,0 +1,182 @@
+// Tag counts as written by MarshalResultsProto, for services returning scan
+// results over gRPC
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: tagpipe.proto
+
+package tagpipe
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type TagCount struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Tag           string                 `protobuf:"bytes,1,opt,name=tag,proto3" json:"tag,omitempty"`
+	Count         int64                  `protobuf:"varint,2,opt,name=count,proto3" json:"count,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TagCount) Reset() {
+	*x = TagCount{}
+	mi := &file_tagpipe_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TagCount) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TagCount) ProtoMessage() {}
+
+func (x *TagCount) ProtoReflect() protoreflect.Message {
+	mi := &file_tagpipe_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TagCount.ProtoReflect.Descriptor instead.
+func (*TagCount) Descriptor() ([]byte, []int) {
+	return file_tagpipe_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *TagCount) GetTag() string {
+	if x != nil {
+		return x.Tag
+	}
+	return ""
+}
+
+func (x *TagCount) GetCount() int64 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+type TagCounts struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Counts        []*TagCount            `protobuf:"bytes,1,rep,name=counts,proto3" json:"counts,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TagCounts) Reset() {
+	*x = TagCounts{}
+	mi := &file_tagpipe_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TagCounts) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TagCounts) ProtoMessage() {}
+
+func (x *TagCounts) ProtoReflect() protoreflect.Message {
+	mi := &file_tagpipe_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TagCounts.ProtoReflect.Descriptor instead.
+func (*TagCounts) Descriptor() ([]byte, []int) {
+	return file_tagpipe_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *TagCounts) GetCounts() []*TagCount {
+	if x != nil {
+		return x.Counts
+	}
+	return nil
+}
+
+var File_tagpipe_proto protoreflect.FileDescriptor
+
+const file_tagpipe_proto_rawDesc = "" +
+	"\n" +
+	"\rtagpipe.proto\x12\atagpipe\"2\n" +
+	"\bTagCount\x12\x10\n" +
+	"\x03tag\x18\x01 \x01(\tR\x03tag\x12\x14\n" +
+	"\x05count\x18\x02 \x01(\x03R\x05count\"6\n" +
+	"\tTagCounts\x12)\n" +
+	"\x06counts\x18\x01 \x03(\v2\x11.tagpipe.TagCountR\x06countsB\x1fZ\x1dgithub.com/keremgocen/tagpipeb\x06proto3"
+
+var (
+	file_tagpipe_proto_rawDescOnce sync.Once
+	file_tagpipe_proto_rawDescData []byte
+)
+
+func file_tagpipe_proto_rawDescGZIP() []byte {
+	file_tagpipe_proto_rawDescOnce.Do(func() {
+		file_tagpipe_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_tagpipe_proto_rawDesc), len(file_tagpipe_proto_rawDesc)))
+	})
+	return file_tagpipe_proto_rawDescData
+}
+
+var file_tagpipe_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_tagpipe_proto_goTypes = []any{
+	(*TagCount)(nil),  // 0: tagpipe.TagCount
+	(*TagCounts)(nil), // 1: tagpipe.TagCounts
+}
+var file_tagpipe_proto_depIdxs = []int32{
+	0, // 0: tagpipe.TagCounts.counts:type_name -> tagpipe.TagCount
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_tagpipe_proto_init() }
+func file_tagpipe_proto_init() {
+	if File_tagpipe_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_tagpipe_proto_rawDesc), len(file_tagpipe_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_tagpipe_proto_goTypes,
+		DependencyIndexes: file_tagpipe_proto_depIdxs,
+		MessageInfos:      file_tagpipe_proto_msgTypes,
+	}.Build()
+	File_tagpipe_proto = out.File
+	file_tagpipe_proto_goTypes = nil
+	file_tagpipe_proto_depIdxs = nil
+}
@@ -0,0 +1,561 @@
+package tagpipe
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// writeTree writes files, contents by slash separated path, under a new temporary
+// directory and returns its path
+func writeTree(t testing.TB, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// Run with -race to check Counter is safe for concurrent use
+func TestCounterConcurrentAdd(t *testing.T) {
+	const goroutines, adds = 50, 200
+
+	var c Counter
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < adds; j++ {
+				c.Add("go", 1)
+				c.Add("rust", 2)
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := TList{{"rust", 2 * goroutines * adds}, {"go", goroutines * adds}}
+	if got := c.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Snapshot() = %v, want %v", got, want)
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	content := `{"langs": ["go", "rust", "go"], "os": "linux"}`
+	root := writeTree(t, map[string]string{"a.json": content})
+	path := filepath.Join(root, "a.json")
+
+	r, err := ParseFile(path, []string{"go", "rust", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum([]byte(content))
+	if r.Path != path || r.Sum != hex.EncodeToString(sum[:]) || r.Size != int64(len(content)) {
+		t.Errorf("got %s with sum %s and size %d, want %s with sum %x and size %d", r.Path, r.Sum, r.Size, path, sum, len(content))
+	}
+	if want := map[string]int{"go": 2, "rust": 1}; !reflect.DeepEqual(r.T, want) {
+		t.Errorf("counts = %v, want %v", r.T, want)
+	}
+}
+
+func TestIsValidNDJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		valid   bool
+		invalid int
+	}{
+		{"all valid", "{\"a\": 1}\n[1, 2]\n\"s\"\n", true, -1},
+		{"one invalid line", "{\"a\": 1}\n{\"b\": \n[3]\n", false, 1},
+		{"blank lines", "\n{\"a\": 1}\n\n   \n{\"b\": 2}\r\n\n", true, -1},
+		{"invalid after blank lines", "\n\n{}\n\n{oops}\n", false, 4},
+		{"empty", "", true, -1},
+	}
+	for _, tt := range tests {
+		valid, invalid, err := IsValidNDJSON(strings.NewReader(tt.input))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if valid != tt.valid || invalid != tt.invalid {
+			t.Errorf("%s: got %v, line %d, want %v, line %d", tt.name, valid, invalid, tt.valid, tt.invalid)
+		}
+	}
+}
+
+// countingFS counts the files opened and the bytes read from them
+type countingFS struct {
+	fs.FS
+	mu    sync.Mutex
+	opens int
+	read  int64
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opens++
+	return &countingFile{f, c}, nil
+}
+
+// ReadDir and Stat aren't counted, and let directories be walked, which the
+// files returned by Open can't
+func (c *countingFS) ReadDir(name string) ([]fs.DirEntry, error) { return fs.ReadDir(c.FS, name) }
+
+func (c *countingFS) Stat(name string) (fs.FileInfo, error) { return fs.Stat(c.FS, name) }
+
+type countingFile struct {
+	fs.File
+	c *countingFS
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.c.mu.Lock()
+	defer f.c.mu.Unlock()
+	f.c.read += int64(n)
+	return n, err
+}
+
+func TestParseFileSinglePass(t *testing.T) {
+	content := strings.Repeat(`{"lang": "go", "tags": ["rust", "go"]}`+"\n", 5000)
+	root := writeTree(t, map[string]string{"a.json": content})
+	path := filepath.Join(root, "a.json")
+	tags := []string{"go", "rust"}
+
+	fsys := &countingFS{FS: osFS{}}
+	r, err := ParseFile(path, tags, WithSinglePass(true), WithFS(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsys.opens != 1 || fsys.read != int64(len(content)) {
+		t.Errorf("opened %d times reading %d bytes, want once reading %d", fsys.opens, fsys.read, len(content))
+	}
+
+	sums, err := MD5All(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sums[path]; r.Sum != hex.EncodeToString(sum[:]) {
+		t.Errorf("sum = %s, want %x", r.Sum, sum)
+	}
+	for _, tag := range tags {
+		want, err := CountTag(strings.NewReader(content), tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.T[tag] != want {
+			t.Errorf("count of %s = %d, want %d", tag, r.T[tag], want)
+		}
+	}
+}
+
+func TestParseFileMatchingOptions(t *testing.T) {
+	content := "TODO: fix\n\"todo\" later todo\n// todo\n"
+	root := writeTree(t, map[string]string{"a.go": content})
+	path := filepath.Join(root, "a.go")
+
+	tests := []struct {
+		name string
+		opts []Option
+		want int
+	}{
+		{"quoted", nil, 1},
+		{"plain", []Option{WithSyntax(SyntaxPlain)}, 3},
+		{"plain ignoring case", []Option{WithSyntax(SyntaxPlain), WithIgnoreCase(true)}, 4},
+		{"whole word", []Option{WithWholeWord(true), WithTrimCutset(`":`), WithIgnoreCase(true)}, 4},
+		{"anchored", []Option{WithSyntax(SyntaxPlain), WithAnchorStart(true), WithIgnoreCase(true)}, 1},
+		{"comments only", []Option{WithSyntax(SyntaxPlain), WithCommentsOnly(true)}, 1},
+	}
+	for _, tt := range tests {
+		for _, singlePass := range []bool{false, true} {
+			r, err := ParseFile(path, []string{"todo"}, append(tt.opts, WithSinglePass(singlePass))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.T["todo"] != tt.want {
+				t.Errorf("%s, single pass %v: count = %d, want %d", tt.name, singlePass, r.T["todo"], tt.want)
+			}
+		}
+	}
+}
+
+func TestParseFileLiteralTags(t *testing.T) {
+	root := writeTree(t, map[string]string{"a.json": `["c++", "a.b", "axb", "go"]`})
+	path := filepath.Join(root, "a.json")
+
+	for _, singlePass := range []bool{false, true} {
+		r, err := ParseFile(path, []string{"c++", "a.b", "g."}, WithSinglePass(singlePass))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]int{"c++": 1, "a.b": 1}; !reflect.DeepEqual(r.T, want) {
+			t.Errorf("single pass %v: counts = %v, want %v", singlePass, r.T, want)
+		}
+	}
+}
+
+// errReadFailed is the error of reads from unreadableFS
+var errReadFailed = errors.New("read failed")
+
+// unreadableFS opens its files but fails to read them, after the first byte
+type unreadableFS struct{ fstest.MapFS }
+
+func (u unreadableFS) Open(name string) (fs.File, error) {
+	f, err := u.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return unreadableFile{f}, nil
+}
+
+type unreadableFile struct{ fs.File }
+
+func (f unreadableFile) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	n, _ := f.File.Read(p)
+	return n, errReadFailed
+}
+
+func TestUnreadableFileHasNoDigest(t *testing.T) {
+	fsys := unreadableFS{fstest.MapFS{"a.json": {Data: []byte(`["go"]`)}}}
+
+	for _, singlePass := range []bool{false, true} {
+		r, err := ParseFile("a.json", []string{"go"}, WithFS(fsys), WithSinglePass(singlePass))
+		if !errors.Is(err, errReadFailed) || r.Sum != "" {
+			t.Errorf("single pass %v: got sum %q, err %v, want no sum and the read error", singlePass, r.Sum, err)
+		}
+	}
+
+	sum, _, err := md5File("a.json", newOptions([]Option{WithFS(fsys)}))
+	if !errors.Is(err, errReadFailed) || sum != [md5.Size]byte{} {
+		t.Errorf("md5File = %x, %v, want a zero sum and the read error", sum, err)
+	}
+	if m, err := MD5All(".", WithFS(fsys)); !errors.Is(err, errReadFailed) || m != nil {
+		t.Errorf("MD5All = %v, %v, want no sums and the read error", m, err)
+	}
+}
+
+func TestBottomN(t *testing.T) {
+	counts := TList{{"go", 5}, {"zig", 1}, {"rust", 3}, {"c", 1}, {"odin", 2}}
+	orig := append(TList(nil), counts...)
+
+	tests := []struct {
+		n    int
+		want TList
+	}{
+		{3, TList{{"c", 1}, {"zig", 1}, {"odin", 2}}},
+		{10, TList{{"c", 1}, {"zig", 1}, {"odin", 2}, {"rust", 3}, {"go", 5}}},
+		{0, TList{}},
+		{-1, TList{}},
+	}
+	for _, tt := range tests {
+		if got := BottomN(counts, tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("BottomN(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+	if !reflect.DeepEqual(counts, orig) {
+		t.Errorf("counts changed to %v", counts)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	counts := TList{{"go", 5}, {"zig", 1}, {"rust", 3}, {"c", 1}, {"odin", 3}}
+	orig := append(TList(nil), counts...)
+	sorted := TList{{"go", 5}, {"odin", 3}, {"rust", 3}, {"c", 1}, {"zig", 1}}
+
+	tests := []struct {
+		offset, limit int
+		want          TList
+	}{
+		{0, 2, sorted[:2]},
+		{2, 2, sorted[2:4]},
+		{4, 2, sorted[4:]},
+		{0, 10, sorted},
+		{5, 2, TList{}},
+		{100, 2, TList{}},
+		{-3, 2, sorted[:2]},
+		{1, -1, TList{}},
+		{0, 0, TList{}},
+	}
+	for _, tt := range tests {
+		if got := Paginate(counts, tt.offset, tt.limit); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Paginate(%d, %d) = %v, want %v", tt.offset, tt.limit, got, tt.want)
+		}
+	}
+	if !reflect.DeepEqual(counts, orig) {
+		t.Errorf("counts changed to %v", counts)
+	}
+
+	// pages cover every count once, whatever order counts come in
+	var pages TList
+	for offset := 0; offset < len(counts); offset += 2 {
+		rev := append(TList(nil), orig...)
+		slices.Reverse(rev)
+		pages = append(pages, Paginate(rev, offset, 2)...)
+	}
+	if !reflect.DeepEqual(pages, sorted) {
+		t.Errorf("pages = %v, want %v", pages, sorted)
+	}
+}
+
+func TestCaseVariants(t *testing.T) {
+	counts := TList{
+		{"TODO", 3}, {"todo", 5}, {"Todo", 1}, {"todo", 2},
+		{"go", 4}, {"Go", 1},
+		{"rust", 2}, {"fixme", 1},
+		{"Straße", 1}, {"STRASSE", 1}, {"straße", 1},
+	}
+	want := map[string][]string{
+		"todo":   {"TODO", "Todo", "todo"},
+		"go":     {"Go", "go"},
+		"straße": {"Straße", "straße"},
+	}
+	if got := CaseVariants(counts); !reflect.DeepEqual(got, want) {
+		t.Errorf("variants = %v, want %v", got, want)
+	}
+	if got := CaseVariants(TList{{"go", 1}, {"rust", 1}}); len(got) != 0 {
+		t.Errorf("variants of distinct tags = %v, want none", got)
+	}
+}
+
+func TestWalkCanceled(t *testing.T) {
+	root := writeTree(t, map[string]string{"a.json": `[]`, "b.json": `[]`})
+
+	done := make(chan struct{})
+	paths, errc, _ := walkFiles(done, root, newOptions(nil))
+	<-paths
+	close(done)
+
+	err := <-errc
+	if !errors.Is(err, ErrWalkCanceled) {
+		t.Errorf("err = %v, want ErrWalkCanceled", err)
+	}
+	if err != nil && err.Error() != "walk canceled" {
+		t.Errorf("message = %q, want %q", err, "walk canceled")
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	for _, s := range []string{
+		`{"tags": ["go", "rust"], "n": 2.5, "ok": true, "none": null}`,
+		`[1, "two", {"three": [3]}, []]`,
+	} {
+		got, err := ParseJSON(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want interface{}
+		if err := json.Unmarshal([]byte(s), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseJSON(%s) = %v, want %v", s, got, want)
+		}
+		if !IsValidJSON(s) {
+			t.Errorf("IsValidJSON(%s) = false", s)
+		}
+	}
+
+	if v, err := ParseJSON(`{"a": `); err == nil || v != nil {
+		t.Errorf("ParseJSON of invalid JSON = %v, %v, want an error", v, err)
+	}
+	if IsValidJSON(`{"a": `) {
+		t.Error("IsValidJSON of invalid JSON = true")
+	}
+}
+
+func TestIncrementTagCount(t *testing.T) {
+	var counts TList
+	for _, tag := range []string{"go", "rust", "go", "zig", "go"} {
+		counts = IncrementTagCount(counts, tag)
+	}
+	if want := (TList{{"go", 3}, {"rust", 1}, {"zig", 1}}); !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts = %v, want %v", counts, want)
+	}
+
+	// existing tags are incremented in place
+	grown := make(TList, 1, 2)
+	grown[0] = T{"go", 5}
+	if got := IncrementTagCount(grown, "go"); &got[0] != &grown[0] || got[0].Count != 6 {
+		t.Errorf("incremented to %v, want go 6 in place", got)
+	}
+}
+
+func TestParseFileNormalizeKeys(t *testing.T) {
+	root := writeTree(t, map[string]string{"a.json": `["Golang", "golang", "GOLANG", "rust"]`})
+	path := filepath.Join(root, "a.json")
+	tags := []string{"Golang", "golang", "Rust"}
+
+	for _, singlePass := range []bool{false, true} {
+		r, err := ParseFile(path, tags, WithIgnoreCase(true), WithNormalizeKeys(true), WithSinglePass(singlePass))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]int{"golang": 3, "rust": 1}; !reflect.DeepEqual(r.T, want) {
+			t.Errorf("single pass %v: counts = %v, want %v", singlePass, r.T, want)
+		}
+
+		r, err = ParseFile(path, tags, WithIgnoreCase(true), WithSinglePass(singlePass))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]int{"Golang": 3, "golang": 3, "Rust": 1}; !reflect.DeepEqual(r.T, want) {
+			t.Errorf("single pass %v, keys not normalized: counts = %v, want %v", singlePass, r.T, want)
+		}
+	}
+}
+
+func TestParseFileIncludeZeros(t *testing.T) {
+	root := writeTree(t, map[string]string{"a.json": `["go", "go"]`})
+	path := filepath.Join(root, "a.json")
+	tags := []string{"go", "rust", " zig "}
+
+	for _, singlePass := range []bool{false, true} {
+		r, err := ParseFile(path, tags, WithIncludeZeros(true), WithSinglePass(singlePass))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]int{"go": 2, "rust": 0, "zig": 0}; !reflect.DeepEqual(r.T, want) {
+			t.Errorf("single pass %v: counts = %v, want %v", singlePass, r.T, want)
+		}
+
+		r, err = ParseFile(path, tags, WithSinglePass(singlePass))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]int{"go": 2}; !reflect.DeepEqual(r.T, want) {
+			t.Errorf("single pass %v, without zeros: counts = %v, want %v", singlePass, r.T, want)
+		}
+	}
+}
+
+func TestSortTagCountsBy(t *testing.T) {
+	counts := TList{{"rust", 2}, {"go", 7}, {"c", 3}, {"zig", 1}}
+
+	SortTagCountsBy(counts, func(a, b T) bool {
+		if len(a.Tag) != len(b.Tag) {
+			return len(a.Tag) < len(b.Tag)
+		}
+		return a.Tag < b.Tag
+	})
+	if want := (TList{{"c", 3}, {"go", 7}, {"zig", 1}, {"rust", 2}}); !reflect.DeepEqual(counts, want) {
+		t.Errorf("by length of tag = %v, want %v", counts, want)
+	}
+
+	SortTagCountsBy(counts, func(a, b T) bool { return a.Count > b.Count })
+	if want := (TList{{"go", 7}, {"c", 3}, {"rust", 2}, {"zig", 1}}); !reflect.DeepEqual(counts, want) {
+		t.Errorf("by count descending = %v, want %v", counts, want)
+	}
+}
+
+// changingFS serves next in place of a file's contents from its second open on,
+// as if it changed between reads
+type changingFS struct {
+	fstest.MapFS
+	next   map[string][]byte
+	mu     sync.Mutex
+	opened map[string]bool
+}
+
+func (c *changingFS) Open(name string) (fs.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if data, ok := c.next[name]; ok && c.opened[name] {
+		return fstest.MapFS{name: {Data: data}}.Open(name)
+	}
+	c.opened[name] = true
+	return c.MapFS.Open(name)
+}
+
+func TestDigestAllFilesReadsOnce(t *testing.T) {
+	inTempDir(t)
+	saved := DefaultCache.Snapshot()
+	defer DefaultCache.reset(saved)
+	defer func(b bool) { uc = b }(uc)
+	DefaultCache.reset(nil)
+
+	fsys := fstest.MapFS{
+		"a.json": {Data: []byte(`["go", "go"]`)},
+		"b.json": {Data: []byte(`["rust"]`)},
+	}
+	want := TList{{"go", 2}, {"rust", 1}}
+
+	for _, tt := range []struct {
+		name     string
+		useCache bool
+		opens    int
+	}{
+		{"no cache", false, 2},
+		{"cache miss", true, 4}, // hashed, then read
+		{"cache hit", true, 2},  // hashed only
+	} {
+		counting := &countingFS{FS: fsys}
+		got, err := DigestAllFiles(".", []string{"go", "rust"}, tt.useCache, WithFS(counting))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: counts = %v, want %v", tt.name, got, want)
+		}
+		if counting.opens != tt.opens {
+			t.Errorf("%s: %d files opened, want %d", tt.name, counting.opens, tt.opens)
+		}
+	}
+}
+
+func TestDigestAllFilesCachesWhatWasParsed(t *testing.T) {
+	inTempDir(t)
+	saved := DefaultCache.Snapshot()
+	defer DefaultCache.reset(saved)
+	defer func(b bool) { uc = b }(uc)
+	DefaultCache.reset(nil)
+	if err := os.Remove("cache"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+
+	before, after := []byte(`["go"]`), []byte(`["go", "go", "go"]`)
+	fsys := &changingFS{
+		MapFS:  fstest.MapFS{"a.json": {Data: before}},
+		next:   map[string][]byte{"a.json": after},
+		opened: make(map[string]bool),
+	}
+	got, err := DigestAllFiles(".", []string{"go"}, true, WithFS(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (TList{{"go", 3}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("counts = %v, want %v", got, want)
+	}
+
+	sum := md5.Sum(before)
+	if r, ok := DefaultCache.get(hex.EncodeToString(sum[:])); ok {
+		t.Errorf("counts of the changed file cached under the sum of its old contents: %v", r.T)
+	}
+	sum = md5.Sum(after)
+	if r, ok := DefaultCache.get(hex.EncodeToString(sum[:])); !ok || r.T["go"] != 3 {
+		t.Errorf("cached %v, %v under the sum of what was parsed, want go 3", r.T, ok)
+	}
+}
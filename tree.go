@@ -0,0 +1,1009 @@
+package tagpipe
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"iter"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats summarizes the work done by a tree scan. A tree with no regular files in
+// it, such as an empty directory or one holding only directories, is scanned
+// successfully with FilesScanned 0.
+type Stats struct {
+	FilesScanned int
+	Elapsed      time.Duration
+}
+
+// TreeReport is the full report of a file tree, as returned by ScanTree
+type TreeReport struct {
+	Digests   map[string][]byte // MD5 sum of each file, by path
+	TagCounts TList             // tag totals across all files, sorted by count
+	Skipped   map[string]error  // files left out of the report, and why
+	Stats     Stats
+}
+
+// ScanTree walks the file tree rooted at root once, collecting the digest of every
+// file along with the total counts of tags. It returns the first error
+// encountered, in which case the report is empty. A tree without files results
+// in non-nil but empty Digests and TagCounts, and a nil error.
+//
+// If ctx is done before the scan completes, as when its deadline or
+// Options.Timeout passes, ScanTree returns the report of the files scanned so
+// far along with ctx.Err(). Reads in flight are abandoned, not waited for.
+func ScanTree(ctx context.Context, root string, tags []string, opts ...Option) (TreeReport, error) {
+	start := time.Now()
+
+	o := newOptions(opts)
+	tags, err := normalizeTags(tags, o)
+	if err != nil {
+		return TreeReport{}, err
+	}
+	var cancel context.CancelFunc
+	if o.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	c, errc := scanFiles(ctx.Done(), root, o, func(path string) Result {
+		return parsePath(path, tags, o)
+	})
+
+	report := TreeReport{Digests: make(map[string][]byte), Skipped: make(map[string]error)}
+	var counter Counter
+collect:
+	for {
+		select {
+		case r, ok := <-c:
+			if !ok {
+				break collect
+			}
+			if r.E != nil {
+				if skipped(r) {
+					report.Skipped[r.Path] = r.E
+					continue
+				}
+				return TreeReport{}, r.E
+			}
+
+			if o.Store != nil {
+				if err := o.Store.Put(r.Path, sortByTagCount(r.T)); err != nil {
+					return TreeReport{}, err
+				}
+			}
+
+			report.Digests[r.Path], _ = hex.DecodeString(r.Sum)
+			for t, n := range r.T {
+				counter.Add(t, n)
+			}
+			report.Stats.FilesScanned++
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	report.TagCounts = counter.Snapshot()
+	report.Stats.Elapsed = time.Since(start)
+
+	// out of time, return what we have
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return TreeReport{}, err
+	}
+	return report, nil
+}
+
+// FileInfo holds the digest and size of a file, as returned by MD5AllWithSizes
+type FileInfo struct {
+	Sum  [md5.Size]byte
+	Size int64
+}
+
+// MD5All reads all the files in the file tree rooted at root and returns a map
+// from file path to the MD5 sum of the file's contents. If the directory walk
+// fails or any read operation fails, MD5All returns an error.
+func MD5All(root string, opts ...Option) (map[string][md5.Size]byte, error) {
+	files, err := MD5AllWithSizes(root, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string][md5.Size]byte, len(files))
+	for path, f := range files {
+		m[path] = f.Sum
+	}
+	return m, nil
+}
+
+// MD5AllWithSizes is like MD5All, but also returns the size of each file. Sizes
+// are counted while hashing, so they're those of the contents the sums are of.
+func MD5AllWithSizes(root string, opts ...Option) (map[string]FileInfo, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	o := newOptions(opts)
+
+	var total, hashed int64
+	if o.Progress != nil && o.TotalSizeEstimate {
+		var err error
+		if total, err = treeSize(root, o); err != nil {
+			return nil, err
+		}
+	}
+
+	c, errc := scanFiles(done, root, o, func(path string) Result {
+		sum, n, err := md5File(path, o)
+		if err != nil {
+			return Result{Path: path, E: err}
+		}
+		return Result{Path: path, Sum: hex.EncodeToString(sum[:]), Size: n}
+	})
+
+	m := make(map[string]FileInfo)
+	for r := range c {
+		if r.E != nil {
+			if skipped(r) {
+				continue
+			}
+			return nil, r.E
+		}
+		f := FileInfo{Size: r.Size}
+		hex.Decode(f.Sum[:], []byte(r.Sum))
+		m[r.Path] = f
+
+		if o.Progress != nil {
+			hashed += r.Size
+			o.Progress(hashed, total)
+		}
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// TreeDigest returns a single digest of the whole file tree rooted at root, for
+// telling whether anything in it changed. Each file is hashed with a new hash
+// from newHash, then their digests are hashed together. So the digest changes
+// when files are added, removed or changed, but not when the tree is moved.
+// With HashPaths set the paths of files relative to root are hashed along with
+// their digests, so renaming or moving a file within the tree changes it too.
+// RelativePaths and NormalizeSlashes are always on, so the digest is the same
+// on any system.
+func TreeDigest(root string, newHash func() hash.Hash, opts ...Option) ([]byte, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	o := newOptions(opts)
+	o.RelativePaths, o.NormalizeSlashes = true, true
+	c, errc := scanFiles(done, root, o, func(path string) Result {
+		h := newHash()
+		if _, err := hashFile(path, o, h); err != nil {
+			return Result{Path: path, E: err}
+		}
+		return Result{Path: path, Sum: hex.EncodeToString(h.Sum(nil))}
+	})
+
+	sums := make(map[string]string)
+	for r := range c {
+		if r.E != nil {
+			if skipped(r) {
+				continue
+			}
+			return nil, r.E
+		}
+		sums[r.Path] = r.Sum
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+
+	h := newHash()
+	if !o.HashPaths {
+		// order by digest, so the order doesn't depend on paths either
+		digests := make([]string, 0, len(sums))
+		for _, sum := range sums {
+			digests = append(digests, sum)
+		}
+		sort.Strings(digests)
+		for _, sum := range digests {
+			fmt.Fprintf(h, "%s\n", sum)
+		}
+		return h.Sum(nil), nil
+	}
+
+	paths := make([]string, 0, len(sums))
+	for path := range sums {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// NUL can't occur in paths and newline can't in hex digests, so the
+	// encoding of entries is unambiguous
+	for _, path := range paths {
+		fmt.Fprintf(h, "%s\x00%s\n", path, sums[path])
+	}
+	return h.Sum(nil), nil
+}
+
+// PathDigest is the MD5 sum of the file at Path
+type PathDigest struct {
+	Path string
+	Sum  [md5.Size]byte
+}
+
+// MD5AllOrderedConcurrent is like MD5All, but hashes files with the given number
+// of workers and returns the sums sorted by path, for stable reports. workers
+// below 1 picks a number based on the size of root, as MD5All does.
+func MD5AllOrderedConcurrent(root string, workers int, opts ...Option) ([]PathDigest, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	o := newOptions(opts)
+	paths, errc, fc := walkFiles(done, root, o)
+	if workers < 1 {
+		workers = digesterCount(fc)
+	}
+	c := processFiles(done, paths, workers, root, o, func(path string) Result {
+		sum, n, err := md5File(path, o)
+		if err != nil {
+			return Result{Path: path, E: err}
+		}
+		return Result{Path: path, Sum: hex.EncodeToString(sum[:]), Size: n}
+	})
+
+	var digests []PathDigest
+	for r := range c {
+		if r.E != nil {
+			if skipped(r) {
+				continue
+			}
+			return nil, r.E
+		}
+		d := PathDigest{Path: r.Path}
+		hex.Decode(d.Sum[:], []byte(r.Sum))
+		digests = append(digests, d)
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+
+	sort.Slice(digests, func(i, j int) bool { return digests[i].Path < digests[j].Path })
+	return digests, nil
+}
+
+// treeSize walks the file tree rooted at root as it would be scanned and returns
+// the total size of its files
+func treeSize(root string, o *Options) (int64, error) {
+	var total int64
+	_, err := statTree(root, o, func(info fs.FileInfo) { total += info.Size() })
+	return total, err
+}
+
+// statTree walks the file tree rooted at root as it would be scanned and calls fn
+// with the FileInfo of each file, without reading them. It returns the number
+// of entries in root, for digesterCount.
+func statTree(root string, o *Options, fn func(info fs.FileInfo)) (int, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	paths, errc, fc := walkFiles(done, root, o)
+	for path := range paths {
+		info, err := fs.Stat(o.fsys(), path)
+		if err != nil {
+			if o.TolerateDisappearing && errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return 0, err
+		}
+		fn(info)
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return 0, err
+	}
+	return fc, nil
+}
+
+// Rough memory costs of a scan, in bytes, for EstimateScanMemory
+const (
+	workerOverhead = 64 << 10 // goroutine stack, read buffers and hashes
+	lineBuffer     = 64 << 10 // lines read at once when reading line by line
+	resultOverhead = 512      // path, digest and tag map kept per file
+)
+
+// EstimateScanMemory walks the file tree rooted at root, without reading files,
+// and returns a rough estimate in bytes of the peak memory a scan of it with
+// opts would take, to tune options before scanning a huge tree. Unless
+// SinglePass is set, or WholeFile is, each worker holds a whole file in memory,
+// so the estimate is as if all of them read the largest file at once. Line by
+// line, memory depends on the longest line instead, which only reading tells,
+// so typical lines are assumed. Results kept per file add to it.
+func EstimateScanMemory(root string, opts ...Option) (int64, error) {
+	o := newOptions(opts)
+
+	var files, largest int64
+	fc, err := statTree(root, o, func(info fs.FileInfo) {
+		files++
+		if info.Size() > largest {
+			largest = info.Size()
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	perWorker := int64(workerOverhead + lineBuffer)
+	if !o.SinglePass || o.WholeFile {
+		perWorker = workerOverhead + largest
+	}
+	workers := int64(digesterCount(fc))
+	if files < workers {
+		workers = files
+	}
+	return workers*perWorker + files*resultOverhead, nil
+}
+
+// MD5AllRoots is like MD5All, but walks each of roots concurrently and merges the
+// results as if they were one tree. It's an error for two roots to contain the
+// same path, as happens when one root is nested in another.
+func MD5AllRoots(roots []string, opts ...Option) (map[string][md5.Size]byte, error) {
+	opts = sharedOptions(opts)
+	sums := make([]map[string][md5.Size]byte, len(roots))
+	err := eachRoot(roots, func(i int, root string) (err error) {
+		sums[i], err = MD5All(root, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string][md5.Size]byte)
+	for _, s := range sums {
+		for path, sum := range s {
+			if _, ok := m[path]; ok {
+				return nil, fmt.Errorf("%s found under more than one root", path)
+			}
+			m[path] = sum
+		}
+	}
+	return m, nil
+}
+
+// ScanRoots is like ScanTree, but walks each of roots concurrently and merges the
+// reports as if they were one tree. It's an error for two roots to contain the
+// same path.
+func ScanRoots(ctx context.Context, roots []string, tags []string, opts ...Option) (TreeReport, error) {
+	start := time.Now()
+
+	opts = sharedOptions(opts)
+	reports := make([]TreeReport, len(roots))
+	err := eachRoot(roots, func(i int, root string) (err error) {
+		reports[i], err = ScanTree(ctx, root, tags, opts...)
+		return err
+	})
+	if err != nil {
+		return TreeReport{}, err
+	}
+
+	merged := TreeReport{Digests: make(map[string][]byte), Skipped: make(map[string]error)}
+	var counter Counter
+	for _, r := range reports {
+		for path, sum := range r.Digests {
+			if _, ok := merged.Digests[path]; ok {
+				return TreeReport{}, fmt.Errorf("%s found under more than one root", path)
+			}
+			merged.Digests[path] = sum
+		}
+		for path, err := range r.Skipped {
+			merged.Skipped[path] = err
+		}
+		for _, t := range r.TagCounts {
+			counter.Add(t.Tag, t.Count)
+		}
+		merged.Stats.FilesScanned += r.Stats.FilesScanned
+	}
+
+	merged.TagCounts = counter.Snapshot()
+	merged.Stats.Elapsed = time.Since(start)
+	return merged, nil
+}
+
+// eachRoot calls fn for each of roots on its own goroutine, and returns the first
+// error any of them returned once all are done
+func eachRoot(roots []string, fn func(i int, root string) error) error {
+	errs := make([]error, len(roots))
+	var wg sync.WaitGroup
+	wg.Add(len(roots))
+	for i, root := range roots {
+		go func(i int, root string) {
+			defer wg.Done()
+			errs[i] = fn(i, root)
+		}(i, root)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Estimate is an approximate count of tags from scanning a sample of a tree
+type Estimate struct {
+	Counts   map[string]float64 // counts in the sample scaled up by 1/Fraction
+	Scanned  []string           // the files in the sample, sorted
+	Fraction float64
+}
+
+// EstimateTagCounts scans only about fraction of the files in the tree rooted at
+// root, picked as WithSampleRate does with seed, and estimates the count of
+// each of tags in the whole tree by scaling up its count in the sample. It's
+// for ballpark numbers on huge trees, which are closer the more evenly tags
+// are spread over files.
+func EstimateTagCounts(root string, tags []string, fraction float64, seed int64, opts ...Option) (Estimate, error) {
+	if fraction <= 0 || fraction > 1 {
+		return Estimate{}, fmt.Errorf("sample fraction %v not in (0, 1]", fraction)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	o := newOptions(opts)
+	o.SampleRate, o.SampleSeed = fraction, seed
+	tags, err := normalizeTags(tags, o)
+	if err != nil {
+		return Estimate{}, err
+	}
+	c, errc := scanFiles(done, root, o, func(path string) Result {
+		return parsePath(path, tags, o)
+	})
+
+	e := Estimate{Counts: make(map[string]float64, len(tags)), Fraction: fraction}
+	for _, tag := range tags {
+		e.Counts[tag] = 0
+	}
+	for r := range c {
+		if r.E != nil {
+			if skipped(r) {
+				continue
+			}
+			return Estimate{}, r.E
+		}
+		e.Scanned = append(e.Scanned, r.Path)
+		for t, n := range r.T {
+			e.Counts[t] += float64(n)
+		}
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return Estimate{}, err
+	}
+
+	for t := range e.Counts {
+		e.Counts[t] /= fraction
+	}
+	sort.Strings(e.Scanned)
+	return e, nil
+}
+
+// MostCommonTag scans the file tree rooted at root for each of candidates, and
+// returns the one with the highest total count along with that count. Ties are
+// resolved alphabetically.
+func MostCommonTag(root string, candidates []string) (string, int, error) {
+	if len(candidates) == 0 {
+		return "", 0, errors.New("no candidate tags given")
+	}
+
+	candidates, err := normalizeTags(candidates, newOptions(nil))
+	if err != nil {
+		return "", 0, err
+	}
+	report, err := ScanTree(context.Background(), root, candidates)
+	if err != nil {
+		return "", 0, err
+	}
+
+	totals := make(map[string]int, len(report.TagCounts))
+	for _, t := range report.TagCounts {
+		totals[t.Tag] = t.Count
+	}
+
+	best, bestCount := "", -1
+	for _, tag := range candidates {
+		n := totals[tag]
+		if n > bestCount || (n == bestCount && tag < best) {
+			best, bestCount = tag, n
+		}
+	}
+	return best, bestCount, nil
+}
+
+// CountTagsByExtension walks the file tree rooted at root and returns the total
+// count of tag across files of each extension, as in ".go". Files without an
+// extension are counted under "".
+func CountTagsByExtension(root, tag string, opts ...Option) (map[string]int, error) {
+	perFile, err := countTagPerFile(context.Background(), root, tag, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]int)
+	for path, n := range perFile {
+		m[filepath.Ext(path)] += n
+	}
+	return m, nil
+}
+
+// CountTagsBySubdir walks the file tree rooted at root and returns the total count
+// of tag across the files under each of its immediate subdirectories, keyed by
+// the subdirectory's name, for a breakdown by project. Files directly in root
+// are counted under ".".
+func CountTagsBySubdir(root, tag string, opts ...Option) (map[string]int, error) {
+	opts = append(opts[:len(opts):len(opts)], WithRelativePaths(true))
+	perFile, err := countTagPerFile(context.Background(), root, tag, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]int)
+	for path, n := range perFile {
+		dir, _, ok := strings.Cut(filepath.ToSlash(path), "/")
+		if !ok {
+			dir = "."
+		}
+		m[dir] += n
+	}
+	return m, nil
+}
+
+// FileTypeBreakdown walks the file tree rooted at root, without reading files, and
+// returns the number of files of each extension that would be scanned, to see
+// what a tree holds before scanning it. Files without an extension are counted
+// under "".
+func FileTypeBreakdown(root string, opts ...Option) (map[string]int, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	paths, errc, _ := walkFiles(done, root, newOptions(opts))
+	m := make(map[string]int)
+	for path := range paths {
+		m[filepath.Ext(path)]++
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CompareTrees walks the file trees rooted at rootA and rootB concurrently and
+// returns, for each path relative to its root found in either, the counts of
+// tag in the file in A and in B, 0 where it's absent, e.g. to review how a
+// refactoring changed the use of a tag
+func CompareTrees(rootA, rootB, tag string, opts ...Option) (map[string][2]int, error) {
+	opts = sharedOptions(append(opts[:len(opts):len(opts)], WithRelativePaths(true)))
+	var counts [2]map[string]int
+	err := eachRoot([]string{rootA, rootB}, func(i int, root string) (err error) {
+		counts[i], err = countTagPerFile(context.Background(), root, tag, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string][2]int)
+	for i, perFile := range counts {
+		for path, n := range perFile {
+			c := m[path]
+			c[i] = n
+			m[path] = c
+		}
+	}
+	return m, nil
+}
+
+// CountPathSegmentsAsTags walks the file tree rooted at root, without reading
+// files, and returns the number of files under each directory name below root,
+// taking directory names as tags. A file in a/b counts once for a and once for
+// b, and directories with the same name in different places count together.
+func CountPathSegmentsAsTags(root string, opts ...Option) (map[string]int, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	paths, errc, _ := walkFiles(done, root, newOptions(opts))
+	m := make(map[string]int)
+	for path := range paths {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil, err
+		}
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		for _, dir := range segments[:len(segments)-1] {
+			m[dir]++
+		}
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CountTagDetailed walks the file tree rooted at root once and returns the total
+// count of tag along with the count in each file, including files where it's 0
+func CountTagDetailed(root, tag string, opts ...Option) (total int, perFile map[string]int, err error) {
+	perFile, err = countTagPerFile(context.Background(), root, tag, opts)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, n := range perFile {
+		total += n
+	}
+	return total, perFile, nil
+}
+
+// CountFilesWithTag walks the file tree rooted at root and returns the number of
+// files tag occurs in at least once, however many times it does
+func CountFilesWithTag(root, tag string, opts ...Option) (int, error) {
+	perFile, err := countTagPerFile(context.Background(), root, tag, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	files := 0
+	for _, n := range perFile {
+		if n > 0 {
+			files++
+		}
+	}
+	return files, nil
+}
+
+// CountTagsWeighted walks the file tree rooted at root and returns the sum of the
+// count of tag in each file multiplied by weight(path), e.g. to make tags in
+// main.go count more. A nil weight weighs every file 1.
+func CountTagsWeighted(root, tag string, weight func(path string) float64, opts ...Option) (float64, error) {
+	perFile, err := countTagPerFile(context.Background(), root, tag, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	var total float64
+	for path, n := range perFile {
+		w := 1.0
+		if weight != nil {
+			w = weight(path)
+		}
+		total += float64(n) * w
+	}
+	return total, nil
+}
+
+// CountTagsRecencyWeighted walks the file tree rooted at root and returns the sum
+// of the count of tag in each file weighted by how recently the file was
+// modified, halving every halfLife of age, so files modified now count fully
+// and the tags still in active use stand out. Files modified in the future
+// count as modified now.
+func CountTagsRecencyWeighted(root, tag string, halfLife time.Duration, opts ...Option) (float64, error) {
+	if halfLife <= 0 {
+		return 0, fmt.Errorf("half-life %v is not positive", halfLife)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	now := time.Now()
+	o := newOptions(opts)
+	c, errc := scanFiles(done, root, o, func(path string) Result {
+		info, err := fs.Stat(o.fsys(), path)
+		if err != nil {
+			return Result{Path: path, E: err}
+		}
+		n, err := countTagInFile(path, tag, o)
+		if err != nil {
+			return Result{Path: path, E: err}
+		}
+		age := max(now.Sub(info.ModTime()), 0)
+		return Result{Path: path, weight: float64(n) * math.Exp2(-float64(age)/float64(halfLife))}
+	})
+
+	var total float64
+	for r := range c {
+		if r.E != nil {
+			if skipped(r) {
+				continue
+			}
+			return 0, r.E
+		}
+		total += r.weight
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// TagsSeq returns an iterator over the count of tag in each file of the tree rooted
+// at root, yielding files as they're processed. The walk starts when ranging
+// begins and is canceled when the loop breaks. The sequence ends early on the
+// first error, which is logged, as is a failed walk. A root that can't be
+// walked then yields nothing, like an empty tree, so use CountTagDetailed to
+// tell them apart.
+func TagsSeq(root, tag string, opts ...Option) iter.Seq2[string, int] {
+	return func(yield func(string, int) bool) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		o := newOptions(opts)
+		c, errc := scanFiles(ctx.Done(), root, o, func(path string) Result {
+			n, err := countTagInFile(path, tag, o)
+			return Result{Path: path, E: err, T: map[string]int{tag: n}}
+		})
+
+		for r := range c {
+			if r.E != nil {
+				if skipped(r) {
+					continue
+				}
+				log.Println("ending tag sequence,", r.E)
+				return
+			}
+			if !yield(r.Path, r.T[tag]) {
+				return
+			}
+		}
+
+		// Check whether the Walk failed.
+		if err := <-errc; err != nil {
+			log.Println("ending tag sequence,", err)
+		}
+	}
+}
+
+// CountTagsInFiles counts tag in each of the listed files on up to workers
+// goroutines, instead of walking a tree. Paths that don't exist, as deleted
+// files in a diff, and files that aren't regular are skipped and left out of
+// the result. Other errors are returned.
+func CountTagsInFiles(paths []string, tag string, workers int, opts ...Option) (map[string]int, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	pc := make(chan string)
+	go func() {
+		defer close(pc)
+		for _, path := range paths {
+			select {
+			case pc <- path:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if workers < 1 {
+		workers = 1
+	}
+	o := newOptions(opts)
+	fsys := o.fsys()
+	c := processFiles(done, pc, workers, "", o, func(path string) Result {
+		info, err := fs.Stat(fsys, path)
+		if errors.Is(err, fs.ErrNotExist) || (err == nil && info.Mode()&skippedModes != 0) {
+			return Result{Path: path}
+		}
+		if err != nil {
+			return Result{Path: path, E: err}
+		}
+
+		n, err := countTagInFile(path, tag, o)
+		return Result{Path: path, E: err, T: map[string]int{tag: n}}
+	})
+
+	m := make(map[string]int)
+	for r := range c {
+		if r.E != nil {
+			if skipped(r) {
+				continue
+			}
+			return nil, r.E
+		}
+		if r.T != nil {
+			m[r.Path] = r.T[tag]
+		}
+	}
+	return m, nil
+}
+
+// MatchLine is a line a tag occurs on
+type MatchLine struct {
+	Line int // 1-based line number
+	Text string
+}
+
+// GrepTree walks the file tree rooted at root and returns the lines of each file
+// where tag occurs, matched according to opts, leaving out files where it
+// doesn't. It stops early, reading files included, when ctx is done and
+// returns ctx.Err().
+func GrepTree(ctx context.Context, root, tag string, opts ...Option) (map[string][]MatchLine, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	o := newOptions(opts)
+	match, err := newMatcher(tag, o)
+	if err != nil {
+		return nil, err
+	}
+
+	c, errc := scanFiles(ctx.Done(), root, o, func(path string) Result {
+		f, err := openFile(path, o)
+		if err != nil {
+			return Result{Path: path, E: err}
+		}
+		defer f.Close()
+
+		lines := make(chan string)
+		readErr := make(chan error, 1)
+		go func() { readErr <- scanLines(ctx, f, lines) }()
+
+		filter := newLineFilter(o)
+		var matches []MatchLine
+		n := 0
+		for line := range lines {
+			n++
+			if match(filter([]byte(line))) > 0 {
+				matches = append(matches, MatchLine{n, line})
+			}
+		}
+		if err := <-readErr; err != nil {
+			return Result{Path: path, E: err}
+		}
+
+		return Result{Path: path, lines: matches}
+	})
+
+	m := make(map[string][]MatchLine)
+	for r := range c {
+		if r.E != nil {
+			if skipped(r) {
+				continue
+			}
+			return nil, r.E
+		}
+		if len(r.lines) > 0 {
+			m[r.Path] = r.lines
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// countTagPerFile walks the file tree rooted at root and returns the count of tag
+// in each file, including files where it's 0
+func countTagPerFile(ctx context.Context, root, tag string, opts []Option) (map[string]int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	o := newOptions(opts)
+	c, errc := scanFiles(ctx.Done(), root, o, func(path string) Result {
+		n, err := countTagInFile(path, tag, o)
+		return Result{Path: path, E: err, T: map[string]int{tag: n}}
+	})
+
+	m := make(map[string]int)
+	for r := range c {
+		if r.E != nil {
+			if skipped(r) {
+				continue
+			}
+			return nil, r.E
+		}
+		m[r.Path] = r.T[tag]
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// countTagInFile returns the count of tag in the file at path
+func countTagInFile(path, tag string, o *Options) (int, error) {
+	f, err := openFile(path, o)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return countReader(f, tag, o)
+}
+
+// TagCooccurrence walks the file tree rooted at root and counts, for each pair of
+// tags, the files both appear in. Pairs are keyed in sorted order, so each is
+// counted once whichever tag comes first in tags.
+func TagCooccurrence(root string, tags []string, opts ...Option) (map[[2]string]int, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	o := newOptions(opts)
+	tags, err := normalizeTags(tags, o)
+	if err != nil {
+		return nil, err
+	}
+	c, errc := scanFiles(done, root, o, func(path string) Result {
+		return parsePath(path, tags, o)
+	})
+
+	m := make(map[[2]string]int)
+	for r := range c {
+		if r.E != nil {
+			if skipped(r) {
+				continue
+			}
+			return nil, r.E
+		}
+
+		// with IncludeZeros, tags missing from the file are in r.T too
+		found := make([]string, 0, len(r.T))
+		for t, n := range r.T {
+			if n > 0 {
+				found = append(found, t)
+			}
+		}
+		sort.Strings(found)
+		for i := range found {
+			for j := i + 1; j < len(found); j++ {
+				m[[2]string{found[i], found[j]}]++
+			}
+		}
+	}
+
+	// Check whether the Walk failed.
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
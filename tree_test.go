@@ -0,0 +1,1358 @@
+package tagpipe
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// failingDirFS is a file system where listing the directories in fail returns
+// their error, as when they're removed while the tree is walked
+type failingDirFS struct {
+	fstest.MapFS
+	fail map[string]error
+}
+
+func (f failingDirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := f.fail[name]; err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return f.MapFS.ReadDir(name)
+}
+
+func TestMD5AllTolerateDisappearing(t *testing.T) {
+	fsys := failingDirFS{
+		MapFS: fstest.MapFS{
+			"a.json":       {Data: []byte(`{}`)},
+			"gone/b.json":  {Data: []byte(`[]`)},
+			"other/c.json": {Data: []byte(`""`)},
+		},
+		fail: map[string]error{"gone": fs.ErrNotExist},
+	}
+
+	if _, err := MD5All(".", WithFS(fsys)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("without TolerateDisappearing, err = %v, want fs.ErrNotExist", err)
+	}
+
+	m, err := MD5All(".", WithFS(fsys), WithTolerateDisappearing(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"a.json", "other/c.json"} {
+		if _, ok := m[path]; !ok {
+			t.Errorf("%s missing from %v", path, m)
+		}
+	}
+	if len(m) != 2 {
+		t.Errorf("got %d sums, want 2", len(m))
+	}
+}
+
+func TestMD5AllTolerateDisappearingOtherErrors(t *testing.T) {
+	fsys := failingDirFS{
+		MapFS: fstest.MapFS{"locked/a.json": {Data: []byte(`{}`)}},
+		fail:  map[string]error{"locked": fs.ErrPermission},
+	}
+
+	_, err := MD5All(".", WithFS(fsys), WithTolerateDisappearing(true))
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("err = %v, want fs.ErrPermission", err)
+	}
+}
+
+func TestMD5AllMatchesReadFile(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"empty":      "",
+		"small.json": `{"tags": ["go"]}`,
+		"big.txt":    strings.Repeat("spanning several read buffers\n", 10000),
+	})
+
+	m, err := MD5All(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 3 {
+		t.Fatalf("got %d sums, want 3", len(m))
+	}
+	for path, sum := range m {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := md5.Sum(data); sum != want {
+			t.Errorf("%s: sum %x, want %x", filepath.Base(path), sum, want)
+		}
+	}
+}
+
+func TestScanTree(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json":     `["go", "go"]`,
+		"sub/b.json": `{"go": "rust"}`,
+	})
+
+	report, err := ScanTree(context.Background(), root, []string{"go", "rust"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Stats.FilesScanned != 2 || len(report.Digests) != 2 {
+		t.Fatalf("scanned %d files with %d digests, want 2", report.Stats.FilesScanned, len(report.Digests))
+	}
+	for path, sum := range report.Digests {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := md5.Sum(data); !reflect.DeepEqual(sum, want[:]) {
+			t.Errorf("%s: digest %x, want %x", filepath.Base(path), sum, want)
+		}
+	}
+	want := TList{{"go", 3}, {"rust", 1}}
+	if !reflect.DeepEqual(report.TagCounts, want) {
+		t.Errorf("TagCounts = %v, want %v", report.TagCounts, want)
+	}
+}
+
+func TestMD5AllRoots(t *testing.T) {
+	src := writeTree(t, map[string]string{"main.json": `["go"]`})
+	docs := writeTree(t, map[string]string{"readme.json": `["go", "docs"]`, "sub/x.json": `{}`})
+
+	m, err := MD5AllRoots([]string{src, docs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		filepath.Join(src, "main.json"),
+		filepath.Join(docs, "readme.json"),
+		filepath.Join(docs, "sub", "x.json"),
+	} {
+		if _, ok := m[path]; !ok {
+			t.Errorf("%s missing from merged sums", path)
+		}
+	}
+	if len(m) != 3 {
+		t.Errorf("got %d sums, want 3", len(m))
+	}
+
+	if _, err := MD5AllRoots([]string{src, src}); err == nil {
+		t.Error("no error for a path found under two roots")
+	}
+}
+
+func TestScanRoots(t *testing.T) {
+	src := writeTree(t, map[string]string{"main.json": `["go"]`})
+	docs := writeTree(t, map[string]string{"readme.json": `["go", "docs"]`})
+
+	report, err := ScanRoots(context.Background(), []string{src, docs}, []string{"go", "docs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Stats.FilesScanned != 2 || len(report.Digests) != 2 {
+		t.Errorf("scanned %d files with %d digests, want 2", report.Stats.FilesScanned, len(report.Digests))
+	}
+	want := TList{{"go", 2}, {"docs", 1}}
+	if !reflect.DeepEqual(report.TagCounts, want) {
+		t.Errorf("TagCounts = %v, want %v", report.TagCounts, want)
+	}
+}
+
+func TestScanTreeWithoutFiles(t *testing.T) {
+	dirsOnly := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dirsOnly, "a", "b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dirsOnly, "c"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, root := range map[string]string{"empty": t.TempDir(), "directories only": dirsOnly} {
+		report, err := ScanTree(context.Background(), root, []string{"go"})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if report.Stats.FilesScanned != 0 || report.Digests == nil || len(report.Digests) != 0 || report.TagCounts == nil || len(report.TagCounts) != 0 {
+			t.Errorf("%s: report = %+v, want empty", name, report)
+		}
+
+		m, err := MD5All(root)
+		if err != nil || m == nil || len(m) != 0 {
+			t.Errorf("%s: MD5All = %v, %v, want an empty map", name, m, err)
+		}
+	}
+}
+
+func TestMostCommonTag(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json": `["go", "rust", "zig", "zig"]`,
+		"b.json": `["go", "rust", "zig"]`,
+		"c.json": `["c"]`,
+	})
+
+	tests := []struct {
+		candidates []string
+		tag        string
+		count      int
+	}{
+		{[]string{"go", "zig", "c"}, "zig", 3},
+		{[]string{"rust", "go"}, "go", 2}, // tie
+		{[]string{"java", "c"}, "c", 1},
+		{[]string{"java", "kotlin"}, "java", 0},
+	}
+	for _, tt := range tests {
+		tag, count, err := MostCommonTag(root, tt.candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag != tt.tag || count != tt.count {
+			t.Errorf("MostCommonTag(%v) = %s, %d, want %s, %d", tt.candidates, tag, count, tt.tag, tt.count)
+		}
+	}
+
+	if _, _, err := MostCommonTag(root, nil); err == nil {
+		t.Error("no error without candidates")
+	}
+}
+
+func TestMD5AllWithSizes(t *testing.T) {
+	files := map[string]string{
+		"empty":  "",
+		"a.json": `{"a": 1}`,
+		"b.txt":  strings.Repeat("x", 100000),
+	}
+	root := writeTree(t, files)
+
+	m, err := MD5AllWithSizes(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != len(files) {
+		t.Fatalf("got %d files, want %d", len(m), len(files))
+	}
+	for name, content := range files {
+		f, ok := m[filepath.Join(root, name)]
+		if !ok {
+			t.Errorf("%s missing", name)
+			continue
+		}
+		if f.Size != int64(len(content)) || f.Sum != md5.Sum([]byte(content)) {
+			t.Errorf("%s: size %d sum %x, want %d %x", name, f.Size, f.Sum, len(content), md5.Sum([]byte(content)))
+		}
+	}
+}
+
+func TestCountTagsByExtension(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"main.go":        `x := "todo" // "todo"`,
+		"pkg/util.go":    `"todo"`,
+		"README.md":      `"todo" list`,
+		"docs/guide.md":  `nothing`,
+		"Makefile":       `# "todo"`,
+		"sub/LICENSE.MD": `"todo"`,
+	})
+
+	got, err := CountTagsByExtension(root, "todo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{".go": 3, ".md": 1, ".MD": 1, "": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CountTagsByExtension = %v, want %v", got, want)
+	}
+}
+
+func TestModifiedAfter(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"old.json":     `["go"]`,
+		"new.json":     `["go", "go"]`,
+		"sub/old.json": `["go"]`,
+	})
+	cutoff := time.Now().Add(-time.Hour)
+	old := cutoff.Add(-24 * time.Hour)
+	for _, name := range []string{"old.json", "sub/old.json"} {
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total, perFile, err := CountTagDetailed(root, "go", WithModifiedAfter(cutoff), WithRelativePaths(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"new.json": 2}; total != 2 || !reflect.DeepEqual(perFile, want) {
+		t.Errorf("counted %d in %v, want 2 in %v", total, perFile, want)
+	}
+}
+
+func TestCountTagDetailed(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json":     `["go", "go", "go"]`,
+		"b.json":     `["rust"]`,
+		"sub/c.json": `{"go": ["go"]}`,
+	})
+
+	total, perFile, err := CountTagDetailed(root, "go", WithRelativePaths(true), WithNormalizeSlashes(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := 0
+	for _, n := range perFile {
+		sum += n
+	}
+	want := map[string]int{"a.json": 3, "b.json": 0, "sub/c.json": 2}
+	if total != 5 || sum != total || !reflect.DeepEqual(perFile, want) {
+		t.Errorf("total %d, per file %v, want 5, %v", total, perFile, want)
+	}
+}
+
+func TestMapFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.json":       {Data: []byte(`["go", "go"]`)},
+		"dir/b.json":   {Data: []byte(`{"go": 1}`)},
+		"dir/sub/c.md": {Data: []byte(`nothing`)},
+	}
+
+	m, err := MD5All(".", WithFS(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != len(fsys) {
+		t.Errorf("got %d sums, want %d", len(m), len(fsys))
+	}
+	for name, f := range fsys {
+		if m[name] != md5.Sum(f.Data) {
+			t.Errorf("%s: sum %x, want %x", name, m[name], md5.Sum(f.Data))
+		}
+	}
+
+	total, perFile, err := CountTagDetailed("dir", "go", WithFS(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"dir/b.json": 1, "dir/sub/c.md": 0}; total != 1 || !reflect.DeepEqual(perFile, want) {
+		t.Errorf("counted %d in %v, want 1 in %v", total, perFile, want)
+	}
+}
+
+// stuckFS is a file system whose files in stuck block on reads until release is
+// closed, as on a hung network mount
+type stuckFS struct {
+	fstest.MapFS
+	stuck   map[string]bool
+	release chan struct{}
+}
+
+func (s stuckFS) Open(name string) (fs.File, error) {
+	f, err := s.MapFS.Open(name)
+	if err != nil || !s.stuck[name] {
+		return f, err
+	}
+	return stuckFile{f, s.release}, nil
+}
+
+type stuckFile struct {
+	fs.File
+	release chan struct{}
+}
+
+func (f stuckFile) Read(p []byte) (int, error) {
+	<-f.release
+	return f.File.Read(p)
+}
+
+// newStuckFS returns a stuckFS of files, released when the test ends
+func newStuckFS(t *testing.T, files fstest.MapFS, stuck ...string) stuckFS {
+	s := stuckFS{files, make(map[string]bool), make(chan struct{})}
+	for _, name := range stuck {
+		s.stuck[name] = true
+	}
+	t.Cleanup(func() { close(s.release) })
+	return s
+}
+
+func TestScanTreeTimeout(t *testing.T) {
+	fsys := newStuckFS(t, fstest.MapFS{
+		"a.json":    {Data: []byte(`["go"]`)},
+		"b.json":    {Data: []byte(`["go", "go"]`)},
+		"slow.json": {Data: []byte(`["go"]`)},
+	}, "slow.json")
+
+	start := time.Now()
+	report, err := ScanTree(context.Background(), ".", []string{"go"}, WithFS(fsys), WithTimeout(200*time.Millisecond))
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("returned after %v, want around the 200ms timeout", elapsed)
+	}
+	want := TList{{"go", 3}}
+	if report.Stats.FilesScanned != 2 || !reflect.DeepEqual(report.TagCounts, want) {
+		t.Errorf("partial report scanned %d files counting %v, want 2 counting %v", report.Stats.FilesScanned, report.TagCounts, want)
+	}
+}
+
+// waitGoroutines waits up to a few seconds for the number of goroutines to drop
+// to n, and reports whether it did
+func waitGoroutines(n int) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if runtime.NumGoroutine() <= n {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTagsSeqBreakStopsWalk(t *testing.T) {
+	const files = 200
+	m := make(fstest.MapFS, files)
+	for i := 0; i < files; i++ {
+		m[fmt.Sprintf("f%03d.json", i)] = &fstest.MapFile{Data: []byte(`["go"]`)}
+	}
+	fsys := &countingFS{FS: m}
+
+	before := runtime.NumGoroutine()
+	seen := 0
+	for path, n := range TagsSeq(".", "go", WithFS(fsys)) {
+		if n != 1 {
+			t.Errorf("%s: count = %d, want 1", path, n)
+		}
+		if seen++; seen == 3 {
+			break
+		}
+	}
+	if seen != 3 {
+		t.Fatalf("saw %d files before the walk ended, want to break at the third", seen)
+	}
+
+	if !waitGoroutines(before) {
+		t.Fatalf("%d goroutines still running after the loop broke, want %d", runtime.NumGoroutine(), before)
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.opens >= files/2 {
+		t.Errorf("opened %d of %d files after breaking at the third", fsys.opens, files)
+	}
+}
+
+// captureLog returns what's logged for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	out := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(out) })
+	return &buf
+}
+
+func TestTagsSeqErrorsLogged(t *testing.T) {
+	logged := captureLog(t)
+	for path := range TagsSeq(filepath.Join(t.TempDir(), "missing"), "go") {
+		t.Errorf("yielded %s from a missing root", path)
+	}
+	if !strings.Contains(logged.String(), "missing") {
+		t.Errorf("log = %q, want the walk error", logged)
+	}
+
+	logged.Reset()
+	fsys := unreadableFS{fstest.MapFS{"a.json": {Data: []byte(`["go"]`)}}}
+	for path := range TagsSeq(".", "go", WithFS(fsys)) {
+		t.Errorf("yielded %s, which can't be read", path)
+	}
+	if !strings.Contains(logged.String(), errReadFailed.Error()) {
+		t.Errorf("log = %q, want the read error", logged)
+	}
+
+	// breaking out of the loop isn't an error
+	logged.Reset()
+	root := writeTree(t, map[string]string{"a.json": `["go"]`, "b.json": `["go"]`})
+	for range TagsSeq(root, "go") {
+		break
+	}
+	if logged.Len() > 0 {
+		t.Errorf("log = %q after breaking out of the loop, want nothing", logged)
+	}
+}
+
+func TestNormalizeSlashes(t *testing.T) {
+	root := writeTree(t, map[string]string{"a.json": `[]`, "sub/deep/b.json": `[]`})
+
+	m, err := MD5All(root, WithNormalizeSlashes(true), WithRelativePaths(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a.json", "sub/deep/b.json"} {
+		if _, ok := m[key]; !ok {
+			t.Errorf("no sum for %s in %v", key, m)
+		}
+	}
+
+	o := newOptions([]Option{WithNormalizeSlashes(true)})
+	path := filepath.Join(root, "sub", "deep", "b.json")
+	if got, want := o.key(root, path), filepath.ToSlash(path); got != want {
+		t.Errorf("key = %s, want %s", got, want)
+	}
+}
+
+func TestRelativePaths(t *testing.T) {
+	root := writeTree(t, map[string]string{"a.json": `[]`, "sub/b.json": `[]`})
+
+	for _, tt := range []struct {
+		relative bool
+		want     []string
+	}{
+		{false, []string{filepath.Join(root, "a.json"), filepath.Join(root, "sub", "b.json")}},
+		{true, []string{"a.json", filepath.Join("sub", "b.json")}},
+	} {
+		m, err := MD5All(root, WithRelativePaths(tt.relative))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != len(tt.want) {
+			t.Errorf("relative %v: got %d sums, want %d", tt.relative, len(m), len(tt.want))
+		}
+		for _, key := range tt.want {
+			if _, ok := m[key]; !ok {
+				t.Errorf("relative %v: no sum for %s in %v", tt.relative, key, m)
+			}
+		}
+	}
+}
+
+func TestCountTagsInFiles(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json":     `["go", "go"]`,
+		"sub/b.json": `["rust"]`,
+	})
+	a, b := filepath.Join(root, "a.json"), filepath.Join(root, "sub", "b.json")
+	missing := filepath.Join(root, "deleted.json")
+
+	m, err := CountTagsInFiles([]string{a, missing, b, filepath.Join(root, "sub")}, "go", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{a: 2, b: 0}; !reflect.DeepEqual(m, want) {
+		t.Errorf("counts = %v, want %v", m, want)
+	}
+
+	fsys := unreadableFS{fstest.MapFS{"a.json": {Data: []byte(`["go"]`)}}}
+	if _, err := CountTagsInFiles([]string{"a.json"}, "go", 1, WithFS(fsys)); !errors.Is(err, errReadFailed) {
+		t.Errorf("err = %v, want the read error", err)
+	}
+}
+
+func TestPerFileTimeout(t *testing.T) {
+	fsys := newStuckFS(t, fstest.MapFS{
+		"a/ok.json":   {Data: []byte(`["go"]`)},
+		"a/slow.json": {Data: []byte(`["go"]`)},
+		"b/ok.json":   {Data: []byte(`["go", "go"]`)},
+		"b/slow.json": {Data: []byte(`["go"]`)},
+	}, "a/slow.json", "b/slow.json")
+	opts := []Option{WithFS(fsys), WithPerFileTimeout(100 * time.Millisecond)}
+
+	report, err := ScanTree(context.Background(), "a", []string{"go"}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Stats.FilesScanned != 1 || !reflect.DeepEqual(report.TagCounts, TList{{"go", 1}}) {
+		t.Errorf("scanned %d files counting %v, want 1 counting go once", report.Stats.FilesScanned, report.TagCounts)
+	}
+	if err := report.Skipped["a/slow.json"]; !errors.Is(err, ErrFileTimeout) || len(report.Skipped) != 1 {
+		t.Errorf("skipped = %v, want a/slow.json timed out", report.Skipped)
+	}
+
+	report, err = ScanRoots(context.Background(), []string{"a", "b"}, []string{"go"}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Stats.FilesScanned != 2 || !reflect.DeepEqual(report.TagCounts, TList{{"go", 3}}) {
+		t.Errorf("roots: scanned %d files counting %v, want 2 counting go 3 times", report.Stats.FilesScanned, report.TagCounts)
+	}
+	for _, path := range []string{"a/slow.json", "b/slow.json"} {
+		if err := report.Skipped[path]; !errors.Is(err, ErrFileTimeout) {
+			t.Errorf("roots: %s skipped with %v, want a timeout", path, err)
+		}
+	}
+}
+
+func TestTagCooccurrence(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json": `["go", "rust", "zig"]`,
+		"b.json": `["rust", "go", "go"]`,
+		"c.json": `["zig"]`,
+		"d.json": `{}`,
+	})
+
+	m, err := TagCooccurrence(root, []string{"zig", "rust", "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[[2]string]int{
+		{"go", "rust"}:  2,
+		{"go", "zig"}:   1,
+		{"rust", "zig"}: 1,
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("co-occurrences = %v, want %v", m, want)
+	}
+}
+
+func TestCountTagsWeighted(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"main.json":        `["go", "go"]`,
+		"lib.json":         `["go"]`,
+		"vendor/dep.json":  `["go", "go", "go"]`,
+		"vendor/more.json": `["go"]`,
+	})
+
+	total, err := CountTagsWeighted(root, "go", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 7 {
+		t.Errorf("unweighted total = %v, want 7", total)
+	}
+
+	weight := func(path string) float64 {
+		switch {
+		case strings.Contains(filepath.ToSlash(path), "/vendor/"):
+			return 0
+		case filepath.Base(path) == "main.json":
+			return 2.5
+		}
+		return 1
+	}
+	total, err = CountTagsWeighted(root, "go", weight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 6 {
+		t.Errorf("weighted total = %v, want 6", total)
+	}
+}
+
+func TestTreeDigest(t *testing.T) {
+	files := map[string]string{"a.json": `["go"]`, "sub/b.json": `{}`}
+	a, b := writeTree(t, files), writeTree(t, files)
+
+	digest := func(root string, opts ...Option) []byte {
+		t.Helper()
+		d, err := TreeDigest(root, md5.New, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	want := digest(a)
+	if got := digest(b); !bytes.Equal(got, want) {
+		t.Fatalf("identical trees digest to %x and %x", want, got)
+	}
+
+	changes := []struct {
+		name   string
+		change func(root string) error
+	}{
+		{"changed", func(root string) error {
+			return os.WriteFile(filepath.Join(root, "a.json"), []byte(`["rust"]`), 0o644)
+		}},
+		{"added", func(root string) error {
+			return os.WriteFile(filepath.Join(root, "c.json"), nil, 0o644)
+		}},
+		{"removed", func(root string) error {
+			return os.Remove(filepath.Join(root, "sub", "b.json"))
+		}},
+	}
+	for _, c := range changes {
+		root := writeTree(t, files)
+		if err := c.change(root); err != nil {
+			t.Fatal(err)
+		}
+		if got := digest(root); bytes.Equal(got, want) {
+			t.Errorf("%s file: digest unchanged", c.name)
+		}
+	}
+
+}
+
+func TestCountTagsBySubdir(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"top.json":            `["go"]`,
+		"api/a.json":          `["go", "go"]`,
+		"api/v1/deep.json":    `["go"]`,
+		"web/b.json":          `["go"]`,
+		"web/c.json":          `["rust"]`,
+		"docs/none/here.json": `{}`,
+	})
+
+	m, err := CountTagsBySubdir(root, "go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{".": 1, "api": 3, "web": 1, "docs": 0}; !reflect.DeepEqual(m, want) {
+		t.Errorf("counts = %v, want %v", m, want)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json":     strings.Repeat(`"go",`, 1000),
+		"sub/b.json": `["go"]`,
+		"sub/c.json": "",
+	})
+
+	var calls int
+	var last, lastTotal int64
+	progress := func(done, total int64) {
+		if done < last {
+			t.Errorf("progress went back from %d to %d", last, done)
+		}
+		calls++
+		last, lastTotal = done, total
+	}
+	if _, err := MD5All(root, WithProgress(progress), WithTotalSizeEstimate(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 3 {
+		t.Errorf("progress called %d times, want once per file", calls)
+	}
+	if lastTotal == 0 || last != lastTotal {
+		t.Errorf("progress ended at %d of %d, want 100%%", last, lastTotal)
+	}
+
+	calls, last = 0, 0
+	if _, err := MD5All(root, WithProgress(progress)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || lastTotal != 0 {
+		t.Errorf("without an estimate: %d calls with total %d, want 3 with total 0", calls, lastTotal)
+	}
+}
+
+func TestNameRegex(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"CHANGELOG.md":        "",
+		"CHANGELOG-2023.json": "",
+		"README.md":           "",
+		"sub/CHANGELOG":       "",
+		"CHANGELOG/notes.txt": "", // directories are walked whatever their name
+	})
+
+	m, err := MD5All(root, WithRelativePaths(true), WithNormalizeSlashes(true), WithNameRegex(regexp.MustCompile(`^CHANGELOG.*`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for path := range m {
+		got = append(got, path)
+	}
+	sort.Strings(got)
+	if want := []string{"CHANGELOG-2023.json", "CHANGELOG.md", "sub/CHANGELOG"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scanned %q, want %q", got, want)
+	}
+
+	if m, err := MD5All(root, WithNameRegex(nil)); err != nil || len(m) != 5 {
+		t.Errorf("nil regex: scanned %d files, %v, want all 5", len(m), err)
+	}
+}
+
+func TestEarlyReturnLeaksNoGoroutines(t *testing.T) {
+	const files = 500
+	m := make(fstest.MapFS, files)
+	for i := 0; i < files; i++ {
+		m[fmt.Sprintf("d%d/f%03d.json", i%10, i)] = &fstest.MapFile{Data: []byte(`["go"]`)}
+	}
+	fsys := unreadableFS{m}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		// the first failed read returns while the walk is still sending paths
+		if _, err := MD5All(".", WithFS(fsys)); !errors.Is(err, errReadFailed) {
+			t.Fatalf("err = %v, want the read error", err)
+		}
+		if _, err := ScanTree(context.Background(), ".", []string{"go"}, WithFS(fsys)); !errors.Is(err, errReadFailed) {
+			t.Fatalf("err = %v, want the read error", err)
+		}
+	}
+
+	if !waitGoroutines(before) {
+		t.Errorf("%d goroutines still running after early returns, want %d", runtime.NumGoroutine(), before)
+	}
+}
+
+func TestMD5AllOrderedConcurrent(t *testing.T) {
+	files := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		files[fmt.Sprintf("d%d/f%02d.json", i%3, 29-i)] = fmt.Sprintf(`["go", %d]`, i)
+	}
+	root := writeTree(t, files)
+
+	want, err := MD5All(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{0, 1, 4} {
+		got, err := MD5AllOrderedConcurrent(root, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%d workers: got %d digests, want %d", workers, len(got), len(want))
+		}
+		if !sort.SliceIsSorted(got, func(i, j int) bool { return got[i].Path < got[j].Path }) {
+			t.Errorf("%d workers: digests aren't sorted by path", workers)
+		}
+		for _, d := range got {
+			if d.Sum != want[d.Path] {
+				t.Errorf("%d workers: %s: sum %x, want %x", workers, d.Path, d.Sum, want[d.Path])
+			}
+		}
+	}
+}
+
+func TestFileTypeBreakdown(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json":         "",
+		"sub/b.json":     "",
+		"main.go":        "",
+		"Makefile":       "",
+		"sub/LICENSE":    "",
+		"archive.tar.gz": "",
+	})
+
+	m, err := FileTypeBreakdown(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{".json": 2, ".go": 1, "": 2, ".gz": 1}; !reflect.DeepEqual(m, want) {
+		t.Errorf("breakdown = %v, want %v", m, want)
+	}
+}
+
+func TestTreeDigestHashPaths(t *testing.T) {
+	files := map[string]string{"a.json": `["go"]`, "sub/b.json": `{}`}
+	renames := map[string][2]string{
+		"renamed": {"a.json", "z.json"},
+		"moved":   {"sub/b.json", "b.json"},
+	}
+
+	for name, rename := range renames {
+		orig, changed := writeTree(t, files), writeTree(t, files)
+		from, to := filepath.Join(changed, filepath.FromSlash(rename[0])), filepath.Join(changed, filepath.FromSlash(rename[1]))
+		if err := os.Rename(from, to); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, hashPaths := range []bool{false, true} {
+			want, err := TreeDigest(orig, md5.New, WithHashPaths(hashPaths))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := TreeDigest(changed, md5.New, WithHashPaths(hashPaths))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(got, want) == hashPaths {
+				t.Errorf("%s file, HashPaths %v: digest changed %v, want %v", name, hashPaths, !hashPaths, hashPaths)
+			}
+		}
+	}
+}
+
+// partlyUnreadableFS fails to read the files in unreadable, as unreadableFS does
+type partlyUnreadableFS struct {
+	fstest.MapFS
+	unreadable map[string]bool
+}
+
+func (p partlyUnreadableFS) Open(name string) (fs.File, error) {
+	f, err := p.MapFS.Open(name)
+	if err != nil || !p.unreadable[name] {
+		return f, err
+	}
+	return unreadableFile{f}, nil
+}
+
+func TestSubtreeErrorPolicy(t *testing.T) {
+	const below = 200
+	m := fstest.MapFS{
+		"bad/a.json":  {Data: []byte(`["go"]`)},
+		"good/a.json": {Data: []byte(`["go"]`)},
+		"good/b.json": {Data: []byte(`["go"]`)},
+		"top.json":    {Data: []byte(`["go"]`)},
+	}
+	for i := 0; i < below; i++ {
+		m[fmt.Sprintf("bad/sub/f%03d.json", i)] = &fstest.MapFile{Data: []byte(`["go"]`)}
+	}
+	fsys := partlyUnreadableFS{m, map[string]bool{"bad/a.json": true}}
+
+	if _, err := ScanTree(context.Background(), ".", []string{"go"}, WithFS(fsys)); !errors.Is(err, errReadFailed) {
+		t.Fatalf("without pruning: err = %v, want the read error", err)
+	}
+
+	report, err := ScanTree(context.Background(), ".", []string{"go"}, WithFS(fsys), WithSubtreeErrorPolicy(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"good/a.json", "good/b.json", "top.json"} {
+		if _, ok := report.Digests[path]; !ok {
+			t.Errorf("sibling %s not scanned", path)
+		}
+	}
+	if err := report.Skipped["bad/a.json"]; !errors.Is(err, ErrSubtreePruned) || !errors.Is(err, errReadFailed) {
+		t.Errorf("bad/a.json skipped with %v, want the read error pruning its directory", err)
+	}
+	// files sent before the read failed may still be scanned, but not the rest
+	scanned := 0
+	for path := range report.Digests {
+		if strings.HasPrefix(path, "bad/") {
+			scanned++
+		}
+	}
+	if scanned > below/2 {
+		t.Errorf("scanned %d files below the pruned directory", scanned)
+	}
+}
+
+func TestSubtreeErrorPolicyTagErrors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a/a.json": {Data: []byte(`["go"]`)},
+		"b/b.json": {Data: []byte(`["go"]`)},
+	}
+	for _, tags := range [][]string{{""}, {"go", " "}} {
+		report, err := ScanTree(context.Background(), ".", tags, WithFS(fsys), WithSubtreeErrorPolicy(true))
+		if !errors.Is(err, ErrEmptyTag) || errors.Is(err, ErrSubtreePruned) {
+			t.Errorf("tags %q: report %+v, err %v, want ErrEmptyTag failing the scan rather than pruning", tags, report, err)
+		}
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	files := make(map[string]string)
+	for i := 0; i < 400; i++ {
+		files[fmt.Sprintf("d%d/f%03d.json", i%4, i)] = `["go"]`
+	}
+	a, b := writeTree(t, files), writeTree(t, files)
+
+	sample := func(root string, seed int64) []string {
+		t.Helper()
+		m, err := MD5All(root, WithSampleRate(0.25, seed), WithRelativePaths(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for path := range m {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	first := sample(a, 42)
+	if n := len(first); n < 60 || n > 140 {
+		t.Errorf("sampled %d of 400 files at a rate of 0.25", n)
+	}
+	for i := 0; i < 3; i++ {
+		if again := sample(a, 42); !reflect.DeepEqual(again, first) {
+			t.Fatalf("run %d sampled %d different files with the same seed", i+2, len(again))
+		}
+	}
+	if other := sample(b, 42); !reflect.DeepEqual(other, first) {
+		t.Error("the same tree at another root sampled different files")
+	}
+	if other := sample(a, 7); reflect.DeepEqual(other, first) {
+		t.Error("another seed sampled the same files")
+	}
+}
+
+func TestEstimateTagCounts(t *testing.T) {
+	// every file has the same tags, so the estimate is only off by how far the
+	// sample's size is from the fraction
+	files := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		files[fmt.Sprintf("d%d/f%04d.json", i%10, i)] = `["go", "go", "rust"]`
+	}
+	root := writeTree(t, files)
+
+	e, err := EstimateTagCounts(root, []string{"go", "rust", "zig"}, 0.2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exact := map[string]float64{"go": 2000, "rust": 1000, "zig": 0}
+	for tag, want := range exact {
+		if got := e.Counts[tag]; math.Abs(got-want) > 0.15*want {
+			t.Errorf("estimate of %s = %v, want %v within 15%%", tag, got, want)
+		}
+	}
+	if e.Fraction != 0.2 || len(e.Scanned) == 0 || len(e.Scanned) == len(files) {
+		t.Errorf("scanned %d of %d files at %v", len(e.Scanned), len(files), e.Fraction)
+	}
+	if !sort.StringsAreSorted(e.Scanned) {
+		t.Error("scanned files aren't sorted")
+	}
+
+	if _, err := EstimateTagCounts(root, []string{"go"}, 0, 1); err == nil {
+		t.Error("no error for a fraction of 0")
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json":       `["go"]`,
+		"l1/b.json":    `["go", "go"]`,
+		"l1/l2/c.json": `["go", "go", "go", "go"]`,
+	})
+
+	for _, tt := range []struct {
+		depth int
+		want  int
+	}{{0, 1}, {1, 3}, {2, 7}, {3, 7}} {
+		total, _, err := CountTagDetailed(root, "go", WithMaxDepth(tt.depth))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != tt.want {
+			t.Errorf("depth %d: total = %d, want %d", tt.depth, total, tt.want)
+		}
+	}
+
+	if total, _, err := CountTagDetailed(root, "go"); err != nil || total != 7 {
+		t.Errorf("unlimited: total = %d, %v, want 7", total, err)
+	}
+}
+
+func TestCompareTrees(t *testing.T) {
+	a := writeTree(t, map[string]string{
+		"same.json":     `["go"]`,
+		"changed.json":  `["go"]`,
+		"only-a.json":   `["go", "go"]`,
+		"sub/both.json": `{}`,
+		"sub/gone.json": `["go"]`,
+	})
+	b := writeTree(t, map[string]string{
+		"same.json":     `["go"]`,
+		"changed.json":  `["go", "go", "go"]`,
+		"only-b.json":   `["go"]`,
+		"sub/both.json": `["go"]`,
+	})
+
+	m, err := CompareTrees(a, b, "go", WithNormalizeSlashes(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][2]int{
+		"same.json":     {1, 1},
+		"changed.json":  {1, 3},
+		"only-a.json":   {2, 0},
+		"only-b.json":   {0, 1},
+		"sub/both.json": {0, 1},
+		"sub/gone.json": {1, 0},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("comparison = %v, want %v", m, want)
+	}
+}
+
+func TestTagCooccurrenceIncludeZeros(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json": `["go", "rust"]`,
+		"b.json": `["zig"]`,
+		"c.json": `{}`,
+	})
+
+	m, err := TagCooccurrence(root, []string{"go", "rust", "zig"}, WithIncludeZeros(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[[2]string]int{{"go", "rust"}: 1}; !reflect.DeepEqual(m, want) {
+		t.Errorf("co-occurrences = %v, want %v", m, want)
+	}
+}
+
+func TestCountFilesWithTag(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"many.json":     strings.Repeat(`"go",`, 50),
+		"one.json":      `["go"]`,
+		"sub/some.json": `["go", "go", "go"]`,
+		"none.json":     `["rust"]`,
+	})
+
+	n, err := CountFilesWithTag(root, "go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("files with the tag = %d, want 3", n)
+	}
+	if n, err := CountFilesWithTag(root, "zig"); err != nil || n != 0 {
+		t.Errorf("files with a missing tag = %d, %v, want 0", n, err)
+	}
+}
+
+func TestGrepTree(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a.json":     "[\n\"go\",\n\"rust\",\n\"go\"\n]",
+		"sub/b.json": `{"go": 1}`,
+		"none.json":  `["rust"]`,
+	})
+
+	m, err := GrepTree(context.Background(), root, "go", WithRelativePaths(true), WithNormalizeSlashes(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]MatchLine{
+		"a.json":     {{2, `"go",`}, {4, `"go"`}},
+		"sub/b.json": {{1, `{"go": 1}`}},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("matches = %v, want %v", m, want)
+	}
+}
+
+// cancelingFS calls cancel when the file named at is opened
+type cancelingFS struct {
+	fstest.MapFS
+	at     string
+	cancel context.CancelFunc
+}
+
+func (c cancelingFS) Open(name string) (fs.File, error) {
+	if name == c.at {
+		c.cancel()
+	}
+	return c.MapFS.Open(name)
+}
+
+func TestGrepTreeCanceled(t *testing.T) {
+	files := fstest.MapFS{}
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("f%03d.json", i)] = &fstest.MapFile{Data: []byte(strings.Repeat("\"go\"\n", 100))}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if m, err := GrepTree(ctx, ".", "go", WithFS(files)); err != context.Canceled || m != nil {
+		t.Errorf("canceled before: got %d files, %v, want context.Canceled", len(m), err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	fsys := cancelingFS{files, "f010.json", cancel}
+	if m, err := GrepTree(ctx, ".", "go", WithFS(fsys)); err != context.Canceled || m != nil {
+		t.Errorf("canceled during: got %d files, %v, want context.Canceled", len(m), err)
+	}
+}
+
+// Run with -race, as the timed out file is still read after GrepTree returns
+func TestGrepTreePerFileTimeout(t *testing.T) {
+	fsys := stuckFS{fstest.MapFS{
+		"a.json":    {Data: []byte(`["go"]`)},
+		"slow.json": {Data: []byte(`["go"]`)},
+	}, map[string]bool{"slow.json": true}, make(chan struct{})}
+
+	before := runtime.NumGoroutine()
+	m, err := GrepTree(context.Background(), ".", "go", WithFS(fsys), WithPerFileTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// let the stuck read finish, as it would once the mount recovers
+	close(fsys.release)
+	if !waitGoroutines(before) {
+		t.Fatalf("%d goroutines still running, want %d", runtime.NumGoroutine(), before)
+	}
+	if want := map[string][]MatchLine{"a.json": {{1, `["go"]`}}}; !reflect.DeepEqual(m, want) {
+		t.Errorf("matches = %v, want %v without the timed out file", m, want)
+	}
+}
+
+func TestEstimateScanMemory(t *testing.T) {
+	const largest = 1 << 20
+	files := map[string]string{"big.json": strings.Repeat("x", largest)}
+	for i := 0; i < 4; i++ {
+		files[fmt.Sprintf("f%d.json", i)] = "small"
+	}
+	files["sub/more.json"] = "small"
+	root := writeTree(t, files)
+
+	// 6 entries at the root, so 6 workers for 6 files
+	const workers, n = 6, 6
+	got, err := EstimateScanMemory(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(workers*(workerOverhead+largest) + n*resultOverhead); got != want {
+		t.Errorf("estimate = %d, want %d for %d workers holding the largest file", got, want, workers)
+	}
+
+	got, err = EstimateScanMemory(root, WithSinglePass(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(workers*(workerOverhead+lineBuffer) + n*resultOverhead); got != want {
+		t.Errorf("single pass estimate = %d, want %d for %d workers reading lines", got, want, workers)
+	}
+
+	// fewer files than workers
+	one := writeTree(t, map[string]string{"a.json": strings.Repeat("x", 100)})
+	got, err = EstimateScanMemory(one)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(workerOverhead + 100 + resultOverhead); got != want {
+		t.Errorf("estimate of one file = %d, want %d", got, want)
+	}
+}
+
+func TestMaxFiles(t *testing.T) {
+	m := fstest.MapFS{}
+	for i := 0; i < 100; i++ {
+		m[fmt.Sprintf("d%d/f%03d.json", i%5, i)] = &fstest.MapFile{Data: []byte(`["go"]`)}
+	}
+
+	for _, n := range []int{1, 7, 100} {
+		fsys := &countingFS{FS: m}
+		report, err := ScanTree(context.Background(), ".", []string{"go"}, WithFS(fsys), WithMaxFiles(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Stats.FilesScanned != n || len(report.Digests) != n || fsys.opens != n {
+			t.Errorf("max %d: scanned %d files, opening %d, want exactly %d", n, report.Stats.FilesScanned, fsys.opens, n)
+		}
+	}
+
+	// the first files in walk order
+	sums, err := MD5All(".", WithFS(m), WithMaxFiles(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"d0/f000.json", "d0/f005.json", "d0/f010.json"} {
+		if _, ok := sums[path]; !ok || len(sums) != 3 {
+			t.Errorf("sums of %v, want the first 3 files in walk order", sums)
+			break
+		}
+	}
+}
+
+func TestCountPathSegmentsAsTags(t *testing.T) {
+	files := map[string]string{
+		"top.json":              `["go"]`,
+		"go/a.json":             `["go"]`,
+		"go/tools/b.json":       `["go"]`,
+		"go/tools/lint/c.json":  `["go"]`,
+		"rust/tools/d.json":     `["rust"]`,
+		"rust/e.json":           `["rust"]`,
+		"docs/empty/.gitignore": ``,
+	}
+	want := map[string]int{"go": 3, "tools": 3, "lint": 1, "rust": 2, "docs": 1, "empty": 1}
+
+	got, err := CountPathSegmentsAsTags(writeTree(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("segments = %v, want %v", got, want)
+	}
+
+	fsys := fstest.MapFS{}
+	for path, content := range files {
+		fsys[path] = &fstest.MapFile{Data: []byte(content)}
+	}
+	counting := &countingFS{FS: fsys}
+	got, err = CountPathSegmentsAsTags(".", WithFS(counting))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("segments in an fs.FS = %v, want %v", got, want)
+	}
+	if counting.opens != 0 {
+		t.Errorf("%d files opened, want none", counting.opens)
+	}
+
+	// below root only
+	got, err = CountPathSegmentsAsTags("go", WithFS(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"tools": 2, "lint": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("segments below go = %v, want %v", got, want)
+	}
+}
+
+func TestCountTagsRecencyWeighted(t *testing.T) {
+	const day = 24 * time.Hour
+	now := time.Now()
+	ages := map[string]time.Duration{"new.json": 0, "day.json": day, "week.json": 7 * day, "future.json": -day}
+	files := make(map[string]string)
+	for path := range ages {
+		files[path] = `["go", "go"]`
+	}
+
+	// each file counts 2, halved every day of age
+	want := 2 + 2*0.5 + 2*math.Exp2(-7) + 2
+	near := func(got float64) bool { return math.Abs(got-want) < 1e-3 }
+
+	root := writeTree(t, files)
+	fsys := fstest.MapFS{}
+	for path, age := range ages {
+		mtime := now.Add(-age)
+		if err := os.Chtimes(filepath.Join(root, path), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		fsys[path] = &fstest.MapFile{Data: []byte(files[path]), ModTime: mtime}
+	}
+
+	got, err := CountTagsRecencyWeighted(root, "go", day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(got) {
+		t.Errorf("weighted count = %v, want %v", got, want)
+	}
+
+	got, err = CountTagsRecencyWeighted(".", "go", day, WithFS(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(got) {
+		t.Errorf("weighted count in an fs.FS = %v, want %v", got, want)
+	}
+
+	// a recent file outweighs an old one with more tags
+	fsys = fstest.MapFS{
+		"old.json":    {Data: []byte(`["go", "go", "go"]`), ModTime: now.Add(-3 * day)},
+		"recent.json": {Data: []byte(`["go"]`), ModTime: now},
+	}
+	old, err := CountTagsRecencyWeighted(".", "go", day, WithFS(fsys), WithNameRegex(regexp.MustCompile(`^old`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent, err := CountTagsRecencyWeighted(".", "go", day, WithFS(fsys), WithNameRegex(regexp.MustCompile(`^recent`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recent <= old {
+		t.Errorf("recent file weighs %v, old file %v, want the recent one more", recent, old)
+	}
+
+	if _, err := CountTagsRecencyWeighted(".", "go", 0, WithFS(fsys)); err == nil {
+		t.Error("zero half-life: no error")
+	}
+}